@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles granted to clients of the admin listener, every role includes the ones before it
+type adminRole int
+
+const (
+	adminRoleNone     adminRole = iota // Not allowed to do anything, other than requests for routes requiring no role
+	adminRoleReader                    // Allowed to read the servers and the metadata
+	adminRoleOperator                  // Allowed to register and update servers as well
+	adminRoleAdmin                     // Allowed to do anything, including removing servers
+)
+
+var adminRoleNames = []string{"none", "reader", "operator", "admin"}
+
+func (role adminRole) String() string {
+	return adminRoleNames[role]
+}
+
+// Returns the role by its name
+func parseAdminRole(name string) (adminRole, bool) {
+	for role, roleName := range adminRoleNames {
+		if strings.EqualFold(name, roleName) {
+			return adminRole(role), true
+		}
+	}
+	return adminRoleNone, false
+}
+
+// Define a struct for an API key and the role it grants
+type adminAPIKey struct {
+	Key  string
+	Name string
+	Role adminRole
+}
+
+// Define a struct for a role granted to a user authenticated using basic authentication or a bearer token
+type adminUser struct {
+	Name string `mapstructure:"name"`
+	Role string `mapstructure:"role"`
+}
+
+// Define a struct for the role required for a route. Paths use the syntax of path.Match, as in "/api/v1/Servers(*)",
+// an empty method, or "*", matches any method and GET matches HEAD as well. Routes requiring the role none are open
+// to anyone, even if anonymous read access is turned off.
+type adminRoute struct {
+	Method string `mapstructure:"method"`
+	Path   string `mapstructure:"path"`
+	Role   string `mapstructure:"role"`
+	role   adminRole
+}
+
+// Define a struct for the client of the admin listener
+type adminPrincipal struct {
+	Name   string
+	Method string // How the client authenticated: anonymous, api-key, basic or bearer
+	Role   adminRole
+}
+
+var (
+	adminPasswords atomic.Pointer[htpasswdFile] // Password file used for basic authentication, if any
+	adminKeySet    atomic.Pointer[jwksFile]     // Key set used to verify bearer tokens, if any
+
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Routes of the admin listener and the role required for them, applied after the configured routes. Routes not
+// matching any of them require the admin role.
+func defaultAdminRoutes() []adminRoute {
+	routes := []adminRoute{
+		{Method: http.MethodGet, Path: "/api/v1/", role: adminRoleReader},
+		{Method: http.MethodGet, Path: "/api/v1/$metadata", role: adminRoleReader},
+		{Method: http.MethodGet, Path: "/api/v1/Servers", role: adminRoleReader},
+		{Method: http.MethodGet, Path: "/api/v1/Servers(*)", role: adminRoleReader},
+		{Method: http.MethodPost, Path: "/api/v1/Servers", role: adminRoleOperator},
+		{Method: http.MethodPatch, Path: "/api/v1/Servers(*)", role: adminRoleOperator},
+		{Method: http.MethodDelete, Path: "/api/v1/Servers(*)", role: adminRoleAdmin},
+	}
+	if isMetricsOnAdminListener() {
+		routes = append(routes, adminRoute{Method: http.MethodGet, Path: viper.GetString("metrics.path"), role: adminRoleReader})
+	}
+	return routes
+}
+
+// Build the API keys, users and routes of the admin listener authentication and load the password and key files
+func buildAdminAuthConfig() error {
+	var errs []error
+
+	// API keys are either specified as plain keys, granting the admin role as they always did, or as a key with a
+	// name and the role it grants
+	keys := []adminAPIKey{}
+	entries, _ := viper.Get("admsrv.auth.api-keys").([]interface{})
+	if entries == nil {
+		for _, key := range viper.GetStringSlice("admsrv.auth.api-keys") {
+			entries = append(entries, key)
+		}
+	}
+	for i, entry := range entries {
+		key := adminAPIKey{Role: adminRoleAdmin}
+		switch value := entry.(type) {
+		case string:
+			key.Key = value
+		case map[string]interface{}:
+			key.Key, _ = value["key"].(string)
+			key.Name, _ = value["name"].(string)
+			if roleName, _ := value["role"].(string); roleName != "" {
+				role, valid := parseAdminRole(roleName)
+				if !valid {
+					errs = append(errs, newConfigError("Invalid API key specified: unknown role, please specify reader, operator or admin", zap.String("name", key.Name), zap.String("role", roleName)))
+					continue
+				}
+				key.Role = role
+			}
+		}
+		if key.Key == "" {
+			errs = append(errs, newConfigError("Invalid API key specified: every API key requires a key", zap.Int("index", i), zap.String("name", key.Name)))
+			continue
+		}
+		if key.Name == "" {
+			key.Name = "api-key-" + strconv.Itoa(i+1)
+		}
+		keys = append(keys, key)
+	}
+	viper.Set("admsrv.auth.api-keys$", keys)
+
+	// Roles of users authenticated using basic authentication or bearer tokens
+	var users []adminUser
+	if err := viper.UnmarshalKey("admsrv.auth.users", &users); err != nil {
+		errs = append(errs, newConfigError("Invalid users specified", zap.Error(err)))
+	}
+	roles := map[string]adminRole{}
+	for _, user := range users {
+		role, valid := parseAdminRole(user.Role)
+		if user.Name == "" || !valid {
+			errs = append(errs, newConfigError("Invalid user specified: every user requires a name and a role of none, reader, operator or admin", zap.String("name", user.Name), zap.String("role", user.Role)))
+			continue
+		}
+		roles[strings.ToLower(user.Name)] = role
+	}
+	viper.Set("admsrv.auth.users$", roles)
+	if _, valid := parseAdminRole(viper.GetString("admsrv.auth.default-role")); !valid {
+		logger.Error("No valid default role specified! Falling back to using default role reader!", zap.String("admsrv.auth.default-role", viper.GetString("admsrv.auth.default-role")))
+		viper.Set("admsrv.auth.default-role", nil)
+	}
+
+	// Configured routes come first, so they can overrule the default ones
+	var routes []adminRoute
+	if err := viper.UnmarshalKey("admsrv.auth.routes", &routes); err != nil {
+		errs = append(errs, newConfigError("Invalid routes specified", zap.Error(err)))
+	}
+	valid := routes[:0]
+	for _, route := range routes {
+		role, validRole := parseAdminRole(route.Role)
+		if _, err := path.Match(route.Path, ""); err != nil || route.Path == "" || !validRole {
+			errs = append(errs, newConfigError("Invalid route specified: every route requires a valid path pattern and a role of none, reader, operator or admin", zap.String("method", route.Method), zap.String("path", route.Path), zap.String("role", route.Role)))
+			continue
+		}
+		route.role = role
+		valid = append(valid, route)
+	}
+	viper.Set("admsrv.auth.routes$", append(valid, defaultAdminRoutes()...))
+
+	// Load the password file and the key set, so any issue with them shows right away
+	if file := viper.GetString("admsrv.auth.htpasswd-file"); file != "" {
+		passwords := &htpasswdFile{file: file}
+		if err := passwords.refresh(); err != nil {
+			errs = append(errs, newConfigError("Invalid password file specified", zap.Error(err), zap.String("admsrv.auth.htpasswd-file", file)))
+		}
+		adminPasswords.Store(passwords)
+	} else {
+		adminPasswords.Store(nil)
+	}
+	if file := viper.GetString("admsrv.auth.jwks-file"); file != "" {
+		keySet := &jwksFile{file: file}
+		if err := keySet.refresh(); err != nil {
+			errs = append(errs, newConfigError("Invalid JSON web key set file specified", zap.Error(err), zap.String("admsrv.auth.jwks-file", file)))
+		}
+		adminKeySet.Store(keySet)
+	} else {
+		adminKeySet.Store(nil)
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the role required for the request
+func requiredAdminRole(r *http.Request) adminRole {
+	routes, _ := viper.Get("admsrv.auth.routes$").([]adminRoute)
+	for _, route := range routes {
+		if route.Method != "" && route.Method != "*" && !strings.EqualFold(route.Method, r.Method) && !(route.Method == http.MethodGet && r.Method == http.MethodHead) {
+			continue
+		}
+		if matched, _ := path.Match(route.Path, r.URL.Path); matched {
+			return route.role
+		}
+	}
+	return adminRoleAdmin
+}
+
+// Returns the role of a user authenticated using basic authentication or a bearer token without a role claim
+func adminUserRole(name string) adminRole {
+	roles, _ := viper.Get("admsrv.auth.users$").(map[string]adminRole)
+	if role, exists := roles[strings.ToLower(name)]; exists {
+		return role
+	}
+	role, _ := parseAdminRole(viper.GetString("admsrv.auth.default-role"))
+	return role
+}
+
+// Returns the API keys configured
+func adminAPIKeys() []adminAPIKey {
+	keys, _ := viper.Get("admsrv.auth.api-keys$").([]adminAPIKey)
+	return keys
+}
+
+// Returns the API key matching the key presented by the client
+func lookupAdminAPIKey(presented string) *adminAPIKey {
+	keys := adminAPIKeys()
+	var found *adminAPIKey
+	for i := range keys {
+		// Compare against every key so the time it takes doesn't tell which key matched
+		if subtle.ConstantTimeCompare([]byte(keys[i].Key), []byte(presented)) == 1 && found == nil {
+			found = &keys[i]
+		}
+	}
+	return found
+}
+
+// Authenticate the client using an API key in the X-API-Key header, basic authentication against the password file
+// or a bearer token, being either an API key or a JSON web token signed by one of the keys in the key set. Clients
+// presenting no credentials at all are anonymous, and may read if allowed. So are clients presenting credentials we
+// have no way to verify, as clients written for v11 send basic authentication whether the server asks for it or not.
+func authenticateAdminRequest(r *http.Request) (*adminPrincipal, error) {
+	if presented := r.Header.Get("X-API-Key"); presented != "" {
+		if key := lookupAdminAPIKey(presented); key != nil {
+			return &adminPrincipal{Name: key.Name, Method: "api-key", Role: key.Role}, nil
+		}
+		return nil, errInvalidCredentials
+	}
+
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic") && adminPasswords.Load() != nil:
+		user, password, ok := r.BasicAuth()
+		if !ok || !adminPasswords.Load().verify(user, password) {
+			return nil, errInvalidCredentials
+		}
+		return &adminPrincipal{Name: user, Method: "basic", Role: adminUserRole(user)}, nil
+	case strings.EqualFold(scheme, "Bearer") && (adminKeySet.Load() != nil || len(adminAPIKeys()) > 0):
+		credentials = strings.TrimSpace(credentials)
+		if key := lookupAdminAPIKey(credentials); key != nil {
+			return &adminPrincipal{Name: key.Name, Method: "api-key", Role: key.Role}, nil
+		}
+		keySet := adminKeySet.Load()
+		if keySet == nil {
+			return nil, errInvalidCredentials
+		}
+		name, role, err := keySet.verifyToken(credentials)
+		if err != nil {
+			return nil, err
+		}
+		return &adminPrincipal{Name: name, Method: "bearer", Role: role}, nil
+	}
+	principal := &adminPrincipal{Name: "anonymous", Method: "anonymous", Role: adminRoleNone}
+	if viper.GetBool("admsrv.auth.anonymous-read") {
+		principal.Role = adminRoleReader
+	}
+	return principal, nil
+}
+
+// Let the client know which authentication schemes it can use
+func writeAuthenticationChallenge(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Add("WWW-Authenticate", `Bearer realm="tm1-v12-admsrv"`)
+	if adminPasswords.Load() != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="tm1-v12-admsrv", charset="UTF-8"`)
+	}
+	writeODataError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, message)
+}
+
+// Authenticate the client and check it has the role required for the request, writing the error if not
+func authorizeAdminRequest(w http.ResponseWriter, r *http.Request) bool {
+	principal, err := authenticateAdminRequest(r)
+	if err != nil {
+		logger.Warn("Authentication of admin request failed", zap.Error(err), zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.String("remote-addr", r.RemoteAddr))
+		writeAuthenticationChallenge(w, r, "The credentials presented are not valid")
+		return false
+	}
+	required := requiredAdminRole(r)
+	if principal.Role >= required {
+		return true
+	}
+
+	// Anonymous clients get the chance to authenticate, others simply aren't allowed
+	if principal.Method == "anonymous" {
+		logger.Debug("Admin request requires authentication", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.String("remote-addr", r.RemoteAddr))
+		writeAuthenticationChallenge(w, r, "Authentication is required to access this resource")
+		return false
+	}
+	logger.Warn("Admin request not allowed for role", zap.String("principal", principal.Name), zap.String("auth-method", principal.Method), zap.Stringer("role", principal.Role), zap.Stringer("required-role", required), zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.String("remote-addr", r.RemoteAddr))
+	writeODataError(w, r, http.StatusForbidden, errorCodeForbidden, "The role '"+principal.Role.String()+"' does not allow this request, the role '"+required.String()+"' is required")
+	return false
+}
+
+// Password file in the format written by htpasswd, re-read whenever the file changed. Passwords need to be hashed
+// using either bcrypt (htpasswd -B) or SHA-1 (htpasswd -s).
+type htpasswdFile struct {
+	file      string
+	mu        sync.Mutex
+	modTime   time.Time
+	passwords map[string]string
+}
+
+// Re-read the password file if the file changed since we last read it. Callers need to hold hf.mu, or be the only
+// one holding a reference to it.
+func (hf *htpasswdFile) refresh() error {
+	info, err := os.Stat(hf.file)
+	if err != nil {
+		return err
+	}
+	if hf.passwords != nil && info.ModTime().Equal(hf.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(hf.file)
+	if err != nil {
+		return err
+	}
+	passwords := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return errors.New("invalid line in password file, expected user:hash")
+		}
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") && !strings.HasPrefix(hash, "{SHA}") {
+			logger.Warn("Password of user hashed using an unsupported algorithm, please use bcrypt, ignoring user", zap.String("htpasswd-file", hf.file), zap.String("user", user))
+			continue
+		}
+		passwords[user] = hash
+	}
+	logger.Info("Password file loaded", zap.String("htpasswd-file", hf.file), zap.Int("users", len(passwords)))
+	hf.modTime = info.ModTime()
+	hf.passwords = passwords
+	return nil
+}
+
+// Returns true if the password is the one of the user
+func (hf *htpasswdFile) verify(user string, password string) bool {
+	hf.mu.Lock()
+	// Keep using the passwords we have if the changed file can't be read, it is likely being written
+	if err := hf.refresh(); err != nil {
+		logger.Warn("Unable to refresh password file, continuing to use the current passwords", zap.Error(err), zap.String("htpasswd-file", hf.file))
+	}
+	hash, exists := hf.passwords[user]
+	hf.mu.Unlock()
+	if !exists {
+		return false
+	}
+	if sha, isSHA := strings.CutPrefix(hash, "{SHA}"); isSHA {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(sha)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
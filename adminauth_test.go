@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAuthenticateAdminRequest(t *testing.T) {
+	viper.Set("admsrv.auth.anonymous-read", true)
+	t.Cleanup(func() {
+		viper.Set("admsrv.auth.anonymous-read", nil)
+		viper.Set("admsrv.auth.api-keys$", nil)
+		adminPasswords.Store(nil)
+	})
+	sum := sha1.Sum([]byte("apple"))
+	passwordFile := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(passwordFile, []byte("admin:{SHA}"+base64.StdEncoding.EncodeToString(sum[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		passwords     bool
+		apiKeys       bool
+		authorization string
+		method        string
+		err           error
+	}{
+		{"no credentials", false, false, "", "anonymous", nil},
+		{"basic without password file", false, false, "Basic Z3Vlc3Q6cGVhcg==", "anonymous", nil},
+		{"bearer without keys", false, false, "Bearer token", "anonymous", nil},
+		{"unknown scheme", true, true, "Negotiate token", "anonymous", nil},
+		{"basic with password file", true, false, "Basic YWRtaW46YXBwbGU=", "basic", nil},
+		{"wrong password", true, false, "Basic YWRtaW46cGVhcg==", "", errInvalidCredentials},
+		{"bearer api key", false, true, "Bearer secret", "api-key", nil},
+		{"wrong api key", false, true, "Bearer token", "", errInvalidCredentials},
+	}
+	for _, test := range tests {
+		adminPasswords.Store(nil)
+		if test.passwords {
+			adminPasswords.Store(&htpasswdFile{file: passwordFile})
+		}
+		viper.Set("admsrv.auth.api-keys$", nil)
+		if test.apiKeys {
+			viper.Set("admsrv.auth.api-keys$", []adminAPIKey{{Key: "secret", Name: "deploy", Role: adminRoleOperator}})
+		}
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/Servers", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		principal, err := authenticateAdminRequest(req)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if err == nil && principal.Method != test.method {
+			t.Errorf("%s: expected to authenticate using %s, got %+v", test.name, test.method, principal)
+		}
+		if principal != nil && principal.Method == "anonymous" && principal.Role != adminRoleReader {
+			t.Errorf("%s: expected anonymous clients to be allowed to read, got %+v", test.name, principal)
+		}
+	}
+}
@@ -3,21 +3,27 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-	"os"
+	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
 )
 
 // Define a struct for our v11 Server type
 type Server struct {
 	Name                         string
 	SelfRegistered               bool
-	Host                         string
+	Host                         string `edm:",nullable"`
 	IPAddress                    NullableString
 	IPv6Address                  NullableString
 	PortNumber                   NullableInt
 	ClientMessagePortNumber      NullableInt
-	HTTPPortNumber               int
+	HTTPPortNumber               int `edm:",nullable"`
 	IsLocal                      bool
 	UsingSSL                     bool
 	SSLCertificateID             NullableString
@@ -26,18 +32,20 @@ type Server struct {
 	ClientExportSSLSvrCert       bool
 	ClientExportSSLSvrKeyID      NullableString
 	AcceptingClients             bool
-	LastUpdated                  string
-	httpServer                   *http.Server `json:"-"`
-}
-
-type ServerResponse struct {
-	ContextURL string `json:"@odata.context"`
-	Server
+	LastUpdated                  string           `edm:"Edm.DateTimeOffset"`
+	httpServer                   *http.Server     `json:"-"`
+	upstreamURL                  string           `json:"-"`
+	instance                     string           `json:"-"`
+	database                     string           `json:"-"`
+	productVersion               string           `json:"-"`
+	balancer                     *replicaBalancer `json:"-"`
 }
 
 type ServersResponse struct {
-	ContextURL string   `json:"@odata.context"`
-	Servers    []Server `json:"value"`
+	ContextURL string        `json:"@odata.context"`
+	Count      *int          `json:"@odata.count,omitempty"`
+	Servers    []odataObject `json:"value"`
+	DeltaLink  string        `json:"@odata.deltaLink,omitempty"`
 }
 
 func NewServer() Server {
@@ -45,49 +53,279 @@ func NewServer() Server {
 	return server
 }
 
-func NewServerResponse(server Server) ServerResponse {
-	response := ServerResponse{ContextURL: "$metadata#Servers/$entity", Server: server}
+// Returns the server as an ordered object, limited to the selected properties if any were selected
+func NewServerObject(server Server, properties []string) odataObject {
+	// Marshal the server first so the properties are encoded exactly as they would be otherwise
+	data, _ := json.Marshal(server)
+	values := map[string]json.RawMessage{}
+	json.Unmarshal(data, &values)
+
+	object := odataObject{}
+	for _, name := range serverPropertyNames {
+		if properties != nil && !slices.Contains(properties, name) {
+			continue
+		}
+		object = append(object, odataProperty{Name: name, Value: values[name]})
+	}
+	return object
+}
+
+func NewServerResponse(server Server, query *serverQuery) odataObject {
+	response := odataObject{{Name: "@odata.context", Value: "$metadata#Servers" + query.selectContext() + "/$entity"}}
+	return append(response, NewServerObject(server, query.selectProperties)...)
+}
+
+// Returns a server that changed as an entity, or as a deleted entity if it got removed or no longer matches the filter
+func NewServerDeltaObject(delta serverDelta, query *serverQuery) odataObject {
+	id := "Servers('" + delta.name + "')"
+	if delta.server == nil || !query.matches(delta.server) {
+		reason := "deleted"
+		if delta.server != nil {
+			reason = "changed"
+		}
+		return odataObject{{Name: "@odata.context", Value: "$metadata#Servers/$deletedEntity"}, {Name: "id", Value: id}, {Name: "reason", Value: reason}}
+	}
+	return append(odataObject{{Name: "@odata.id", Value: id}}, NewServerObject(*delta.server, query.selectProperties)...)
+}
+
+func NewServersDeltaResponse(deltas []serverDelta, query *serverQuery, deltaLink string) ServersResponse {
+	response := ServersResponse{ContextURL: "$metadata#Servers" + query.selectContext() + "/$delta", Servers: []odataObject{}, DeltaLink: deltaLink}
+	for _, delta := range deltas {
+		// Servers that never matched the filter are unknown to the client
+		if delta.concerns(query) {
+			response.Servers = append(response.Servers, NewServerDeltaObject(delta, query))
+		}
+	}
 	return response
 }
 
-func NewServersResponse(servers []Server) ServersResponse {
-	response := ServersResponse{ContextURL: "$metadata#Servers", Servers: servers}
+func NewServersResponse(servers []Server, query *serverQuery, count int) ServersResponse {
+	response := ServersResponse{ContextURL: "$metadata#Servers" + query.selectContext(), Servers: []odataObject{}}
+	for _, server := range servers {
+		response.Servers = append(response.Servers, NewServerObject(server, query.selectProperties))
+	}
+	if query.count {
+		response.Count = &count
+	}
 	return response
 }
 
+// Clients can force the servers to be refreshed, instead of getting them as last polled, using the 'refresh' custom query option
+func isRefreshRequested(r *http.Request) bool {
+	refresh, err := strconv.ParseBool(r.URL.Query().Get("refresh"))
+	return err == nil && refresh
+}
+
+// Let the client know how stale the servers are using the Age and Last-Modified headers
+func setServersAgeHeader(w http.ResponseWriter) {
+	lastRefreshed := serversLastRefreshed()
+	if lastRefreshed.IsZero() {
+		// The servers haven't been refreshed yet, the empty list is as old as we are
+		lastRefreshed = serversListedSince
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(lastRefreshed).Seconds())))
+	w.Header().Set("Last-Modified", lastRefreshed.UTC().Format(http.TimeFormat))
+}
+
+// Clients ask for changes to be tracked using the odata.track-changes preference
+func isTrackChangesPreferred(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(preference), "=")
+			if strings.EqualFold(name, "odata.track-changes") || strings.EqualFold(name, "track-changes") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the link to request the changes since the token, for the servers matching the same filter and selection
+func serversDeltaLink(r *http.Request, token string) string {
+	link := "Servers?"
+	values := r.URL.Query()
+	for _, option := range []string{"$filter", "$select"} {
+		if value := values.Get(option); value != "" {
+			link += option + "=" + url.QueryEscape(value) + "&"
+		}
+	}
+	return link + "$deltatoken=" + url.QueryEscape(token)
+}
+
+// Write the error returned when registering, updating or deleting a server
+func writeRegistrationError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errServerExists:
+		writeODataError(w, r, http.StatusConflict, errorCodeServerExists, err.Error())
+	case errServerNotFound:
+		writeODataError(w, r, http.StatusNotFound, errorCodeServerNotFound, err.Error())
+	case errServerNotRegistered:
+		writeODataError(w, r, http.StatusBadRequest, errorCodeServerNotRegistered, err.Error())
+	case errNoPortAvailable, errPinnedPortNotFree:
+		writeODataError(w, r, http.StatusServiceUnavailable, errorCodeNoPortAvailable, err.Error())
+	default:
+		writeODataError(w, r, http.StatusBadRequest, errorCodeInvalidRequestBody, err.Error())
+	}
+}
+
+// Handler for POST requests on the Servers entity set, registering a server manually
+func registerServerResource(w http.ResponseWriter, r *http.Request) {
+	// Decode the server to register, servers accept clients unless specified otherwise
+	var body struct {
+		Name             string
+		UpstreamURL      string
+		AcceptingClients *bool
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		writeODataError(w, r, http.StatusBadRequest, errorCodeInvalidRequestBody, "Invalid request body: "+err.Error())
+		return
+	}
+	registered := RegisteredServer{Name: body.Name, UpstreamURL: body.UpstreamURL, AcceptingClients: true}
+	if body.AcceptingClients != nil {
+		registered.AcceptingClients = *body.AcceptingClients
+	}
+
+	// Register the server and return the newly created entity
+	server, err := registerServer(registered)
+	if err != nil {
+		writeRegistrationError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/Servers('"+url.PathEscape(server.Name)+"')")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(NewServerResponse(*server, &serverQuery{}))
+}
+
+// Handler for PATCH requests on a Server entity, updating a manually registered server
+func updateServerResource(w http.ResponseWriter, r *http.Request, name string) {
+	// Decode the changes to apply
+	var patch RegisteredServerPatch
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		writeODataError(w, r, http.StatusBadRequest, errorCodeInvalidRequestBody, "Invalid request body: "+err.Error())
+		return
+	}
+	if err := updateRegisteredServer(name, patch); err != nil {
+		writeRegistrationError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for DELETE requests on a Server entity, removing a manually registered server
+func deleteServerResource(w http.ResponseWriter, r *http.Request, name string) {
+	if err := unregisterServer(name); err != nil {
+		writeRegistrationError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // Handler for requests for the Servers entity set
 func serverCollectionResource(w http.ResponseWriter, r *http.Request) {
-	// Only allow GET requests
+	// Servers can be registered manually using POST
+	if r.Method == http.MethodPost {
+		registerServerResource(w, r)
+		return
+	}
+
+	// Otherwise only allow GET requests
 	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", "GET")
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, "GET, POST")
+		return
+	}
+
+	// Parse the system query options before doing any actual work
+	query, queryErr := parseServerQuery(r.URL.Query(), true)
+	if queryErr != nil {
+		writeODataError(w, r, queryErr.statusCode, queryErr.code, queryErr.message)
+		return
+	}
+
+	// Stream the changes to the servers to clients asking for events
+	if acceptsEventStream(r) {
+		serverEventsResource(w, r, query)
 		return
 	}
 
-	// Get the list of currently active servers
-	servers := listServers()
+	// Return only the changes since the delta token, if specified
+	if query.deltaToken != "" {
+		serversDeltaResource(w, r, query)
+		return
+	}
+
+	// Get the list of currently active servers and apply the query to it, along with the token to request the changes
+	// from here on if changes are to be tracked, which can't be done if the servers get paged or ordered
+	var serversResponse ServersResponse
+	if isTrackChangesPreferred(r) && query.tracksChanges() {
+		servers, token := trackServers(isRefreshRequested(r))
+		servers, count := query.apply(servers)
+		serversResponse = NewServersResponse(servers, query, count)
+		serversResponse.DeltaLink = serversDeltaLink(r, token)
+		w.Header().Set("Preference-Applied", "odata.track-changes")
+	} else {
+		servers, count := query.apply(listServers(isRefreshRequested(r)))
+		serversResponse = NewServersResponse(servers, query, count)
+	}
 
 	// Return the Servers collection as JSON
-	serversResponse := NewServersResponse(servers)
+	setServersAgeHeader(w)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(serversResponse)
 }
 
+// Handler for requests for the changes made to the Servers entity set since a delta token
+func serversDeltaResource(w http.ResponseWriter, r *http.Request, query *serverQuery) {
+	deltas, token, _, err := serverChangesSince(query.deltaToken)
+	if err != nil {
+		writeODataError(w, r, http.StatusGone, errorCodeDeltaTokenExpired, err.Error())
+		return
+	}
+
+	// Return the changes as JSON, along with the link to request the changes from here on
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(NewServersDeltaResponse(deltas, query, serversDeltaLink(r, token)))
+}
+
 // Handler for request for a single Server entity
 func serverResource(w http.ResponseWriter, r *http.Request, name string) {
-	// Only allow GET requests
+	// Servers registered manually can be updated using PATCH and removed using DELETE
+	switch r.Method {
+	case http.MethodPatch:
+		updateServerResource(w, r, name)
+		return
+	case http.MethodDelete:
+		deleteServerResource(w, r, name)
+		return
+	}
+
+	// Otherwise only allow GET requests
 	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", "GET")
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, "GET, PATCH, DELETE")
+		return
+	}
+
+	// Parse the system query options, only $select applies to a single entity
+	query, queryErr := parseServerQuery(r.URL.Query(), false)
+	if queryErr != nil {
+		writeODataError(w, r, queryErr.statusCode, queryErr.code, queryErr.message)
 		return
 	}
 
 	// Look up the server in list of currently active servers
-	server := lookupServer(name)
+	server := lookupServer(name, isRefreshRequested(r))
+	setServersAgeHeader(w)
 	if server == nil {
-		http.NotFound(w, r)
+		writeODataError(w, r, http.StatusNotFound, errorCodeServerNotFound, "No server named '"+name+"' found")
 		return
 	}
 
@@ -95,15 +333,14 @@ func serverResource(w http.ResponseWriter, r *http.Request, name string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(NewServerResponse(*server))
+	json.NewEncoder(w).Encode(NewServerResponse(*server, query))
 }
 
 // OData metadata document handler, returning either JSON/XML version
 func metadataResource(w http.ResponseWriter, r *http.Request) {
 	// Only allow GET requests
 	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", "GET")
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, "GET")
 		return
 	}
 
@@ -111,7 +348,7 @@ func metadataResource(w http.ResponseWriter, r *http.Request) {
 	accept := r.URL.Query().Get("$format")
 	if accept != "" {
 		if accept != "application/json" && accept != "application/xml" {
-			http.Error(w, "Content-Type specified in $format query parameter not supported", http.StatusBadRequest)
+			writeODataError(w, r, http.StatusBadRequest, errorCodeUnsupportedFormat, "Content-Type specified in $format query parameter not supported")
 			return
 		}
 	} else {
@@ -119,29 +356,18 @@ func metadataResource(w http.ResponseWriter, r *http.Request) {
 		accept = r.Header.Get("Accept")
 	}
 
+	// Build the metadata documents from our model if we haven't done so yet
+	buildMetadataDocuments()
+
 	// XML is the default return JSON if explicitly allowed
 	if strings.Contains(accept, "application/json") {
-		// Read the XML version of the metadata document
-		data, err := os.ReadFile("./metadata.json")
-		if err != nil {
-			http.Error(w, "Failed to read $metadata (JSON) file", http.StatusInternalServerError)
-			return
-		}
-		// Write the response
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		w.Write(data)
+		w.Write(metadataJSON)
 	} else {
-		// Read the XML version of the metadata document
-		data, err := os.ReadFile("./metadata.xml")
-		if err != nil {
-			http.Error(w, "Failed to read $metadata (XML) file", http.StatusInternalServerError)
-			return
-		}
-		// Write the response
 		w.Header().Set("Content-Type", "application/xml")
 		w.WriteHeader(http.StatusOK)
-		w.Write(data)
+		w.Write(metadataXML)
 	}
 }
 
@@ -149,21 +375,17 @@ func metadataResource(w http.ResponseWriter, r *http.Request) {
 func serviceDocumentResource(w http.ResponseWriter, r *http.Request) {
 	// Only allow GET requests
 	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", "GET")
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, "GET")
 		return
 	}
 
-	// Read the service document
-	data, err := os.ReadFile("./service.json")
-	if err != nil {
-		http.Error(w, "Failed to read service document (JSON) file", http.StatusInternalServerError)
-		return
-	}
+	// Build the service document from our model if we haven't done so yet
+	buildMetadataDocuments()
+
 	// Write the response
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+	w.Write(serviceDocumentJSON)
 }
 
 type admsrvRouter struct{}
@@ -172,12 +394,23 @@ type admsrvRouter struct{}
 var serverPathRegex = regexp.MustCompile(`^Servers\(\'([^\/]+)\'\)$`)
 
 func (t *admsrvRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Authenticate the client and check its role allows the request
+	if !authorizeAdminRequest(w, r) {
+		return
+	}
+
+	// Serve the metrics, if served by the admin listener
+	if r.URL.Path == viper.GetString("metrics.path") && isMetricsOnAdminListener() {
+		promhttp.Handler().ServeHTTP(w, r)
+		return
+	}
+
 	// Ensure the path starts with "/api/v1/"
 	segments := strings.SplitN(r.URL.Path[1:], "/", 3) // Split into max 3 parts
 
 	// Check if the first two fragments are the common prefix "api/v1"
 	if len(segments) < 3 || segments[0] != "api" || segments[1] != "v1" {
-		http.NotFound(w, r)
+		writeResourceNotFound(w, r)
 		return
 	}
 	path := segments[2]
@@ -196,6 +429,6 @@ func (t *admsrvRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else if path == "" {
 		serviceDocumentResource(w, r)
 	} else {
-		http.NotFound(w, r)
+		writeResourceNotFound(w, r)
 	}
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Define a struct for the credentials used to authenticate with a TM1 v12 service instance
+type tm1AuthConfig struct {
+	Basic struct {
+		Username string `mapstructure:"username"`
+		Password string `mapstructure:"password"`
+	} `mapstructure:"basic"`
+	Bearer struct {
+		Token string `mapstructure:"token"`
+	} `mapstructure:"bearer"`
+	OAuth2 oauth2Config `mapstructure:"oauth2"`
+}
+
+// Define a struct for the OAuth2 client credentials configuration, tokens are only valid for the configuration they got issued for
+type oauth2Config struct {
+	TokenURL         string   `mapstructure:"token-url"`
+	ClientID         string   `mapstructure:"client-id"`
+	ClientSecret     string   `mapstructure:"client-secret"`
+	Scopes           []string `mapstructure:"scopes"`
+	Audience         string   `mapstructure:"audience"`
+	ClientAuthMethod string   `mapstructure:"client-auth-method"`
+	RefreshBefore    string   `mapstructure:"refresh-before"`
+}
+
+// Define a struct for a token request that is in progress, allowing others to wait for it
+type tokenFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// Define a token source caching the access token and refreshing it before it expires
+type oauth2TokenSource struct {
+	mu          sync.Mutex
+	config      oauth2Config
+	accessToken string
+	expiry      time.Time
+	fetching    *tokenFetch
+}
+
+// Define a struct for the response of the token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+var (
+	tokenSourcesMu sync.Mutex
+	tokenSources   = map[string]*oauth2TokenSource{}
+)
+
+// Returns the token source for the TM1 v12 service instance
+func tokenSourceFor(instance string) *oauth2TokenSource {
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+	ts, exists := tokenSources[instance]
+	if !exists {
+		ts = &oauth2TokenSource{}
+		tokenSources[instance] = ts
+	}
+	return ts
+}
+
+// Returns a valid access token, only blocking if there is no valid token to return while a new one is being requested
+func (ts *oauth2TokenSource) token(config oauth2Config) (string, error) {
+	ts.mu.Lock()
+	// Throw away the cached token if the configuration changed
+	if !reflect.DeepEqual(ts.config, config) {
+		ts.config = config
+		ts.accessToken = ""
+		ts.expiry = time.Time{}
+		ts.fetching = nil
+	}
+
+	now := time.Now()
+	valid := ts.accessToken != "" && now.Before(ts.expiry)
+	refreshBefore, _ := time.ParseDuration(config.RefreshBefore)
+	if valid && now.Before(ts.expiry.Add(-refreshBefore)) {
+		// The token isn't about to expire, use it
+		token := ts.accessToken
+		ts.mu.Unlock()
+		return token, nil
+	}
+
+	// Time to get a new token, unless someone else is getting one already
+	fetch := ts.fetching
+	if fetch == nil {
+		fetch = &tokenFetch{done: make(chan struct{})}
+		ts.fetching = fetch
+		go ts.fetch(config, fetch)
+	}
+	if valid {
+		// The token is about to expire but still valid, keep using it while the new one is being requested
+		token := ts.accessToken
+		ts.mu.Unlock()
+		return token, nil
+	}
+	ts.mu.Unlock()
+
+	// No valid token, wait for the new one
+	<-fetch.done
+	if fetch.err != nil {
+		return "", fetch.err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.accessToken == "" {
+		return "", errors.New("OAuth2 configuration changed while requesting an access token")
+	}
+	return ts.accessToken, nil
+}
+
+// Forget the cached token, for when the TM1 v12 service rejected it
+func (ts *oauth2TokenSource) invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.accessToken = ""
+	ts.expiry = time.Time{}
+}
+
+func (ts *oauth2TokenSource) fetch(config oauth2Config, fetch *tokenFetch) {
+	accessToken, expiresIn, err := requestClientCredentialsToken(config)
+
+	ts.mu.Lock()
+	if err == nil && reflect.DeepEqual(ts.config, config) {
+		ts.accessToken = accessToken
+		ts.expiry = time.Now().Add(expiresIn)
+		logger.Debug("Obtained OAuth2 access token for TM1 v12 service", zap.String("token-url", config.TokenURL), zap.Time("expiry", ts.expiry))
+	}
+	if ts.fetching == fetch {
+		ts.fetching = nil
+	}
+	ts.mu.Unlock()
+
+	if err != nil {
+		logger.Error("Unable to obtain OAuth2 access token for TM1 v12 service", zap.String("token-url", config.TokenURL), zap.Error(err))
+	}
+	fetch.err = err
+	close(fetch.done)
+}
+
+// Request an access token from the token endpoint using the client credentials grant
+func requestClientCredentialsToken(config oauth2Config) (string, time.Duration, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(config.Scopes) > 0 {
+		form.Set("scope", strings.Join(config.Scopes, " "))
+	}
+	if config.Audience != "" {
+		form.Set("audience", config.Audience)
+	}
+	if config.ClientAuthMethod == "post" {
+		form.Set("client_id", config.ClientID)
+		form.Set("client_secret", config.ClientSecret)
+	}
+
+	req, err := http.NewRequest("POST", config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if config.ClientAuthMethod != "post" {
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, err
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.New("token endpoint returned no access token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, errors.New("token endpoint returned unsupported token type '" + token.TokenType + "'")
+	}
+
+	// Tokens without an expiry are used for a limited amount of time regardless
+	expiresIn := time.Duration(token.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 5 * time.Minute
+	}
+	return token.AccessToken, expiresIn, nil
+}
+
+// Add the Authorization header, as per the configured authentication mode, to a request for a TM1 v12 service instance
+func authorizeTM1Request(req *http.Request, instance *tm1Instance) error {
+	if instance.Auth.OAuth2.TokenURL != "" {
+		token, err := tokenSourceFor(instance.Name).token(instance.Auth.OAuth2)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if instance.Auth.Bearer.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+instance.Auth.Bearer.Token)
+	} else {
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(instance.Auth.Basic.Username+":"+instance.Auth.Basic.Password)))
+	}
+	return nil
+}
+
+// Let the authentication know the TM1 v12 service instance rejected the credentials
+func tm1RequestUnauthorized(instance *tm1Instance) {
+	if instance.Auth.OAuth2.TokenURL != "" {
+		tokenSourceFor(instance.Name).invalidate()
+	}
+}
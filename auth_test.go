@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Define a stand-in for a token endpoint, issuing numbered tokens using the client credentials grant
+type tokenEndpoint struct {
+	mu        sync.Mutex
+	requests  int
+	expiresIn int
+	status    int
+	tokenType string
+	noToken   bool
+	forms     []map[string]string
+}
+
+func (te *tokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	te.requests++
+	r.ParseForm()
+	form := map[string]string{"content-type": r.Header.Get("Content-Type")}
+	for name := range r.PostForm {
+		form[name] = r.PostForm.Get(name)
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		form["basic-user"], form["basic-password"] = user, password
+	}
+	te.forms = append(te.forms, form)
+
+	if te.status != 0 && te.status != http.StatusOK {
+		http.Error(w, `{"error":"invalid_client"}`, te.status)
+		return
+	}
+	response := map[string]interface{}{"token_type": "Bearer", "expires_in": te.expiresIn}
+	if te.tokenType != "" {
+		response["token_type"] = te.tokenType
+	}
+	if !te.noToken {
+		response["access_token"] = "token-" + strconv.Itoa(te.requests)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (te *tokenEndpoint) requestCount() int {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	return te.requests
+}
+
+// Start a token endpoint, returning it along with the configuration to request tokens from it
+func startTokenEndpoint(t *testing.T) (*tokenEndpoint, oauth2Config) {
+	endpoint := &tokenEndpoint{expiresIn: 3600}
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+	return endpoint, oauth2Config{
+		TokenURL:         server.URL + "/oauth/token",
+		ClientID:         "admsrv",
+		ClientSecret:     "s3cret",
+		Scopes:           []string{"tm1.read", "tm1.write"},
+		ClientAuthMethod: "basic",
+		RefreshBefore:    "60s",
+	}
+}
+
+func TestOAuth2TokenFetch(t *testing.T) {
+	endpoint, config := startTokenEndpoint(t)
+	ts := &oauth2TokenSource{}
+
+	token, err := ts.token(config)
+	if err != nil || token != "token-1" {
+		t.Fatalf("expected token-1, got %q, %v", token, err)
+	}
+	form := endpoint.forms[0]
+	if form["grant_type"] != "client_credentials" || form["scope"] != "tm1.read tm1.write" || form["content-type"] != "application/x-www-form-urlencoded" {
+		t.Errorf("unexpected token request %v", form)
+	}
+	if form["basic-user"] != "admsrv" || form["basic-password"] != "s3cret" || form["client_id"] != "" {
+		t.Errorf("expected the client to authenticate using basic authentication only, got %v", form)
+	}
+
+	// Clients can post their credentials instead
+	config.ClientAuthMethod = "post"
+	config.Audience = "tm1"
+	if _, err := ts.token(config); err != nil {
+		t.Fatal(err)
+	}
+	form = endpoint.forms[1]
+	if form["client_id"] != "admsrv" || form["client_secret"] != "s3cret" || form["audience"] != "tm1" || form["basic-user"] != "" {
+		t.Errorf("expected the client to post its credentials, got %v", form)
+	}
+}
+
+func TestOAuth2TokenCachedUntilExpiry(t *testing.T) {
+	endpoint, config := startTokenEndpoint(t)
+	ts := &oauth2TokenSource{}
+
+	for i := 0; i < 3; i++ {
+		if token, err := ts.token(config); err != nil || token != "token-1" {
+			t.Fatalf("request %d: expected the cached token-1, got %q, %v", i, token, err)
+		}
+	}
+	if endpoint.requestCount() != 1 {
+		t.Errorf("expected a single token request, got %d", endpoint.requestCount())
+	}
+
+	// Once expired, a new token is requested before returning
+	ts.mu.Lock()
+	ts.expiry = time.Now().Add(-time.Second)
+	ts.mu.Unlock()
+	if token, err := ts.token(config); err != nil || token != "token-2" {
+		t.Fatalf("expected token-2 once token-1 expired, got %q, %v", token, err)
+	}
+
+	// Changing the configuration throws the cached token away
+	config.Scopes = []string{"tm1.read"}
+	if token, err := ts.token(config); err != nil || token != "token-3" {
+		t.Fatalf("expected token-3 after the configuration changed, got %q, %v", token, err)
+	}
+
+	// As does the TM1 v12 service rejecting it
+	ts.invalidate()
+	if token, err := ts.token(config); err != nil || token != "token-4" {
+		t.Fatalf("expected token-4 after the token got invalidated, got %q, %v", token, err)
+	}
+}
+
+func TestOAuth2TokenRefreshedBeforeExpiry(t *testing.T) {
+	endpoint, config := startTokenEndpoint(t)
+	config.RefreshBefore = "1h"
+	endpoint.expiresIn = 1800
+	ts := &oauth2TokenSource{}
+
+	if token, err := ts.token(config); err != nil || token != "token-1" {
+		t.Fatalf("expected token-1, got %q, %v", token, err)
+	}
+
+	// The token is about to expire, it keeps being used while a new one gets requested in the background
+	if token, err := ts.token(config); err != nil || token != "token-1" {
+		t.Fatalf("expected token-1 to be used while refreshing, got %q, %v", token, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ts.mu.Lock()
+		token, fetching := ts.accessToken, ts.fetching
+		ts.mu.Unlock()
+		if token == "token-2" && fetching == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected token-2 to be obtained in the background, got %q", token)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOAuth2TokenErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		tokenType string
+		noToken   bool
+		expected  string
+	}{
+		{"rejected", http.StatusUnauthorized, "", false, "401"},
+		{"unsupported token type", http.StatusOK, "mac", false, "unsupported token type"},
+		{"no access token", http.StatusOK, "", true, "no access token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			endpoint, config := startTokenEndpoint(t)
+			endpoint.status, endpoint.tokenType, endpoint.noToken = test.status, test.tokenType, test.noToken
+			ts := &oauth2TokenSource{}
+
+			if _, err := ts.token(config); err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Fatalf("expected an error containing %q, got %v", test.expected, err)
+			}
+
+			// Failures aren't cached, the next request tries again
+			endpoint.mu.Lock()
+			endpoint.status, endpoint.tokenType, endpoint.noToken = 0, "", false
+			endpoint.mu.Unlock()
+			if token, err := ts.token(config); err != nil || token != "token-2" {
+				t.Fatalf("expected token-2 once the endpoint recovered, got %q, %v", token, err)
+			}
+		})
+	}
+
+	// Token endpoints that can't be reached
+	_, config := startTokenEndpoint(t)
+	config.TokenURL = "http://127.0.0.1:1/oauth/token"
+	if _, err := (&oauth2TokenSource{}).token(config); err == nil {
+		t.Error("expected an error for a token endpoint that can't be reached")
+	}
+}
+
+func TestAuthorizeTM1Request(t *testing.T) {
+	_, config := startTokenEndpoint(t)
+	tests := []struct {
+		name     string
+		instance tm1Instance
+		expected string
+	}{
+		{"oauth2", tm1Instance{Name: "test-oauth2", Auth: tm1AuthConfig{OAuth2: config}}, "Bearer token-1"},
+		{"bearer", func() tm1Instance {
+			instance := tm1Instance{Name: "test-bearer"}
+			instance.Auth.Bearer.Token = "static"
+			return instance
+		}(), "Bearer static"},
+		{"basic", func() tm1Instance {
+			instance := tm1Instance{Name: "test-basic"}
+			instance.Auth.Basic.Username, instance.Auth.Basic.Password = "admin", "apple"
+			return instance
+		}(), "Basic YWRtaW46YXBwbGU="},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://tm1/api/v1/Databases", nil)
+		if err := authorizeTM1Request(req, &test.instance); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if auth := req.Header.Get("Authorization"); auth != test.expected {
+			t.Errorf("%s: expected Authorization %q, got %q", test.name, test.expected, auth)
+		}
+	}
+}
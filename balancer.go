@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Name of the cookie in which TM1 returns the session ID
+const sessionCookieName = "TM1SessionId"
+
+// Define a struct for a replica requests can be forwarded to
+type replicaTarget struct {
+	id    string
+	url   string
+	proxy *httputil.ReverseProxy
+}
+
+// Define a struct for a session pinned to a replica
+type pinnedSession struct {
+	replica  string
+	lastUsed time.Time
+}
+
+// Define a balancer spreading requests for a server across the ready replicas of its database. Writes go to the writer
+// replica, moving the session they are made on along with them, other requests for a session stick to the replica the
+// session is pinned to and other reads are distributed round robin.
+type replicaBalancer struct {
+	mu       sync.Mutex
+	server   string
+	fallback http.Handler
+	replicas []*replicaTarget
+	writer   *replicaTarget
+	next     int
+	sessions map[string]*pinnedSession
+}
+
+func newReplicaBalancer(server string) *replicaBalancer {
+	return &replicaBalancer{server: server, sessions: map[string]*pinnedSession{}}
+}
+
+// Set the handler used if no replica is ready to take the request
+func (b *replicaBalancer) setFallback(fallback http.Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fallback = fallback
+}
+
+// Update the replicas in rotation based on the active replicas of the database, keeping the proxies for replicas that
+// remain ready so the listener never needs to be restarted
+func (b *replicaBalancer) update(instance *tm1Instance, database *Database) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// No replica URL template, no balancing, all requests go to the service root of the database
+	if instance.ReplicaURLTemplate == "" {
+		b.replicas = nil
+		b.writer = nil
+		return
+	}
+
+	replicas := []*replicaTarget{}
+	var writer *replicaTarget
+	for _, replica := range database.ActiveReplicas {
+		if replica.State != "ready" {
+			continue
+		}
+		target, err := instance.replicaServiceRootURL(database.Name, replica.ID)
+		if err != nil {
+			logger.Error("Unable to render replica URL template", zap.Error(err), zap.String("server", b.server), zap.String("replica", replica.ID))
+			continue
+		}
+
+		// Reuse the existing proxy for the replica if it didn't move
+		index := slices.IndexFunc(b.replicas, func(r *replicaTarget) bool { return r.id == replica.ID && r.url == target })
+		var rt *replicaTarget
+		if index >= 0 {
+			rt = b.replicas[index]
+		} else {
+			targetURL, err := url.Parse(target)
+			if err != nil {
+				logger.Error("Unable to add replica to rotation, replica URL template rendered an invalid URL", zap.Error(err), zap.String("server", b.server), zap.String("replica", replica.ID))
+				continue
+			}
+			rt = &replicaTarget{id: replica.ID, url: target, proxy: newServerReverseProxy(b.server, targetURL)}
+			b.pinSessions(rt)
+			logger.Info("Replica added to rotation", zap.String("server", b.server), zap.String("replica", replica.ID), zap.String("role", replica.Role), zap.String("url", target))
+		}
+		replicas = append(replicas, rt)
+		if strings.EqualFold(replica.Role, instance.WriterRole) {
+			writer = rt
+		}
+	}
+
+	// Log the replicas that left the rotation and forget the sessions pinned to them
+	for _, rt := range b.replicas {
+		if !slices.Contains(replicas, rt) {
+			logger.Info("Replica removed from rotation", zap.String("server", b.server), zap.String("replica", rt.id))
+			for id, session := range b.sessions {
+				if session.replica == rt.id {
+					delete(b.sessions, id)
+				}
+			}
+		}
+	}
+	b.replicas = replicas
+	b.writer = writer
+
+	// Clean up sessions that haven't been used for a while
+	idleTimeout := viper.GetDuration("servers.session-affinity-timeout")
+	for id, session := range b.sessions {
+		if time.Since(session.lastUsed) > idleTimeout {
+			delete(b.sessions, id)
+		}
+	}
+}
+
+// Make sure sessions created on the replica get pinned to it. Callers need to hold mu.
+func (b *replicaBalancer) pinSessions(rt *replicaTarget) {
+	rt.proxy.ModifyResponse = func(resp *http.Response) error {
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == sessionCookieName && cookie.Value != "" {
+				b.mu.Lock()
+				b.sessions[cookie.Value] = &pinnedSession{replica: rt.id, lastUsed: time.Now()}
+				b.mu.Unlock()
+			}
+		}
+		return nil
+	}
+}
+
+// Actions that change the data or metadata of a database, keyed by the entity set they are bound to, an empty entity set
+// for actions that are unbound. Any other action, like executing MDX or a view, only reads.
+var writeActions = map[string][]string{
+	"":          {"ExecuteProcess", "ExecuteProcessWithReturn"},
+	"Cellsets":  {"tm1.Update"},
+	"Chores":    {"tm1.Execute", "tm1.Activate", "tm1.Deactivate"},
+	"Cubes":     {"tm1.Update", "tm1.Clear", "tm1.Load", "tm1.Unload", "tm1.Lock", "tm1.Unlock", "tm1.SaveData"},
+	"Processes": {"tm1.Execute", "tm1.ExecuteWithReturn"},
+}
+
+// Returns true if the request changes the data or metadata of the database, requiring the writer replica. What
+// decides that is the action invoked, as TM1 is often asked to read using a POST, or else creating, updating or
+// deleting an entity. Cellsets are the exception, they get created and deleted just to read cells.
+func isWriteRequest(r *http.Request) bool {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/")
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	entitySet := func(segment string) string {
+		name, _, _ := strings.Cut(segment, "(")
+		return name
+	}
+
+	// Actions are either bound to an entity or entity set, or invoked on the service root
+	last := entitySet(segments[len(segments)-1])
+	if strings.HasPrefix(last, "tm1.") || (len(segments) == 1 && strings.HasPrefix(last, "Execute")) {
+		boundTo := ""
+		if len(segments) > 1 {
+			boundTo = entitySet(segments[len(segments)-2])
+		}
+		return slices.Contains(writeActions[boundTo], last)
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	switch entitySet(segments[0]) {
+	case "ActiveSession":
+		return false
+	case "Cellsets":
+		// Only updating the cells of a cellset writes
+		return r.Method == http.MethodPatch && len(segments) > 1
+	}
+	return true
+}
+
+// Pick the replica to forward the request to, nil if there is none in rotation
+func (b *replicaBalancer) pick(r *http.Request) *replicaTarget {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.replicas) == 0 {
+		return nil
+	}
+
+	// Writes go to the writer replica if there is one, the session the write is made on moving along with it so the
+	// session gets to read what it wrote
+	var session *pinnedSession
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		session = b.sessions[cookie.Value]
+	}
+	if b.writer != nil && isWriteRequest(r) {
+		if session != nil {
+			session.replica, session.lastUsed = b.writer.id, time.Now()
+		}
+		return b.writer
+	}
+
+	// Other requests for an existing session go to the replica the session is pinned to, if still in rotation
+	if session != nil {
+		for _, rt := range b.replicas {
+			if rt.id == session.replica {
+				session.lastUsed = time.Now()
+				return rt
+			}
+		}
+	}
+
+	// Any other request is forwarded to the next replica in line
+	b.next = (b.next + 1) % len(b.replicas)
+	return b.replicas[b.next]
+}
+
+// Returns the URL of the replica the request would be forwarded to, empty if there is no replica in rotation
+func (b *replicaBalancer) targetURL(r *http.Request) string {
+	if rt := b.pick(r); rt != nil {
+		return rt.url
+	}
+	return ""
+}
+
+func (b *replicaBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt := b.pick(r); rt != nil {
+		rt.proxy.ServeHTTP(w, r)
+		return
+	}
+	b.mu.Lock()
+	fallback := b.fallback
+	b.mu.Unlock()
+	fallback.ServeHTTP(w, r)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsWriteRequest(t *testing.T) {
+	tests := []struct {
+		method   string
+		path     string
+		expected bool
+	}{
+		{http.MethodGet, "/api/v1/Cubes", false},
+		{http.MethodPost, "/api/v1/ExecuteMDX?$expand=Cells", false},
+		{http.MethodPost, "/api/v1/Cubes('Sales')/Views('Default')/tm1.Execute", false},
+		{http.MethodPost, "/api/v1/Cubes('Sales')/tm1.Update", true},
+		{http.MethodPost, "/api/v1/Processes('Load%2FSales')/tm1.ExecuteWithReturn", true},
+		{http.MethodPost, "/api/v1/ExecuteProcessWithReturn", true},
+		{http.MethodPost, "/api/v1/Chores('Nightly')/tm1.Execute", true},
+		{http.MethodPost, "/api/v1/Cellsets('abc')/tm1.Update", true},
+		{http.MethodPatch, "/api/v1/Cellsets('abc')/Cells", true},
+		{http.MethodDelete, "/api/v1/Cellsets('abc')", false},
+		{http.MethodPost, "/api/v1/ActiveSession/tm1.Close", false},
+		{http.MethodPost, "/api/v1/Dimensions", true},
+		{http.MethodPatch, "/api/v1/Cubes('Sales')", true},
+		{http.MethodDelete, "/api/v1/Dimensions('Period')", true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://tm1"+test.path, nil)
+		if actual := isWriteRequest(req); actual != test.expected {
+			t.Errorf("%s %s: expected write %t, got %t", test.method, test.path, test.expected, actual)
+		}
+	}
+}
+
+func TestReplicaBalancerHonoursSessionPin(t *testing.T) {
+	b := newReplicaBalancer("Sales")
+	reader, writer := &replicaTarget{id: "replica-1"}, &replicaTarget{id: "replica-0"}
+	b.replicas, b.writer = []*replicaTarget{reader, writer}, writer
+	b.sessions["s1"] = &pinnedSession{replica: reader.id}
+
+	// Reads posted on a session stay on the replica the session is pinned to, until its first write moves the session
+	// to the writer replica for good
+	for _, test := range []struct {
+		path     string
+		expected *replicaTarget
+	}{
+		{"/api/v1/ExecuteMDX", reader},
+		{"/api/v1/Cubes('Sales')/tm1.Update", writer},
+		{"/api/v1/ExecuteMDX", writer},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://tm1"+test.path, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "s1"})
+		if rt := b.pick(req); rt != test.expected {
+			t.Errorf("%s: expected replica %s, got %v", test.path, test.expected.id, rt)
+		}
+	}
+
+	// Without a session, reads posted are spread while writes go to the writer
+	req := httptest.NewRequest(http.MethodPost, "http://tm1/api/v1/Cubes('Sales')/tm1.Update", nil)
+	if rt := b.pick(req); rt != writer {
+		t.Errorf("expected the writer replica for a write, got %v", rt)
+	}
+	seen := map[*replicaTarget]bool{}
+	for i := 0; i < 2; i++ {
+		seen[b.pick(httptest.NewRequest(http.MethodPost, "http://tm1/api/v1/ExecuteMDX", nil))] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected reads posted to be spread across both replicas, got %d", len(seen))
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Certificate and key file pair served by our listeners, reloaded whenever either of the files changes
+type certificateReloader struct {
+	certFile    string
+	keyFile     string
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	reloadTimer *time.Timer
+}
+
+var (
+	certificateReloaders   = map[string]*certificateReloader{}
+	certificateReloadersMu sync.Mutex
+	certificatesWatcher    *fsnotify.Watcher
+	certificateExpiryOnce  sync.Once
+)
+
+// How long we wait for the writes to the certificate and key files to settle before reloading them
+const certificateReloadDelay = 500 * time.Millisecond
+
+// Returns the reloader for a certificate and key file pair, loading and starting to watch the files if this is the
+// first listener using them. Listeners sharing the same files share the same reloader.
+func certificateFor(certFile string, keyFile string) (*certificateReloader, error) {
+	certificateReloadersMu.Lock()
+	defer certificateReloadersMu.Unlock()
+
+	certFile, _ = filepath.Abs(certFile)
+	keyFile, _ = filepath.Abs(keyFile)
+	key := certFile + "|" + keyFile
+	if reloader, exists := certificateReloaders[key]; exists {
+		return reloader, nil
+	}
+
+	// Load the certificate, there is nothing to serve if it is not valid to start with
+	certificate, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile, certificate: certificate}
+	certificateReloaders[key] = reloader
+	logger.Info("Certificate loaded", zap.String("cert-file", certFile), zap.String("subject", certificate.Leaf.Subject.String()), zap.Time("not-after", certificate.Leaf.NotAfter))
+	checkCertificateExpiry(reloader)
+
+	// Watch the directories rather than the files themselves, renewals typically replace the files rather than write them
+	if certificatesWatcher == nil {
+		certificatesWatcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			logger.Error("Failed to initialize certificates file watcher, certificates will not be reloaded", zap.Error(err))
+			return reloader, nil
+		}
+		go watchCertificateFiles()
+	}
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := certificatesWatcher.Add(dir); err != nil {
+			logger.Error("Failed to start watching the certificates directory", zap.Error(err), zap.String("directory", dir))
+		}
+	}
+
+	// Keep an eye on the expiry dates of the certificates while we are running
+	certificateExpiryOnce.Do(func() {
+		go func() {
+			for range time.Tick(24 * time.Hour) {
+				certificateReloadersMu.Lock()
+				for _, reloader := range certificateReloaders {
+					checkCertificateExpiry(reloader)
+				}
+				certificateReloadersMu.Unlock()
+			}
+		}()
+	})
+	return reloader, nil
+}
+
+// Returns a TLS configuration serving the certificate and key file pair, picking up any renewed certificate
+func newReloadingTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	reloader, err := certificateFor(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: reloader.getCertificate}, nil
+}
+
+// Load and validate a certificate and key file pair
+func loadCertificate(certFile string, keyFile string) (*tls.Certificate, error) {
+	// Loading the pair verifies the private key matches the public key of the certificate
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	certificate.Leaf = leaf
+	if time.Now().After(leaf.NotAfter) {
+		return nil, errors.New("certificate expired on " + leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &certificate, nil
+}
+
+func (cr *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.certificate, nil
+}
+
+// Reload the certificate, keeping the current one if the new pair is not valid, as would be the case when only one
+// of the files was replaced so far
+func (cr *certificateReloader) reload() {
+	certificate, err := loadCertificate(cr.certFile, cr.keyFile)
+	if err != nil {
+		logger.Warn("Changed certificate not valid, continuing to serve the current certificate", zap.Error(err), zap.String("cert-file", cr.certFile), zap.String("key-file", cr.keyFile))
+		return
+	}
+	cr.mu.Lock()
+	cr.certificate = certificate
+	cr.mu.Unlock()
+	logger.Info("Certificate reloaded", zap.String("cert-file", cr.certFile), zap.String("subject", certificate.Leaf.Subject.String()), zap.Time("not-after", certificate.Leaf.NotAfter))
+	checkCertificateExpiry(cr)
+}
+
+// Log a warning if the certificate expires within the configured number of days
+func checkCertificateExpiry(cr *certificateReloader) {
+	cr.mu.RLock()
+	notAfter := cr.certificate.Leaf.NotAfter
+	cr.mu.RUnlock()
+	certificateExpiry.WithLabelValues(cr.certFile).Set(float64(notAfter.Unix()))
+
+	warningDays := viper.GetInt("certificates.expiry-warning-days")
+	if remaining := time.Until(notAfter); remaining < time.Duration(warningDays)*24*time.Hour {
+		logger.Warn("Certificate expires soon, please renew it", zap.String("cert-file", cr.certFile), zap.Time("not-after", notAfter), zap.Int("days-remaining", int(remaining.Hours()/24)))
+	}
+}
+
+func watchCertificateFiles() {
+	for {
+		select {
+		case event, ok := <-certificatesWatcher.Events:
+			if !ok {
+				return
+			}
+
+			// Reload the certificates using the changed file, once the changes settled as the certificate and key
+			// files typically get replaced one after the other
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			name := filepath.Clean(event.Name)
+			certificateReloadersMu.Lock()
+			for _, reloader := range certificateReloaders {
+				if name == reloader.certFile || name == reloader.keyFile {
+					if reloader.reloadTimer == nil {
+						reloader.reloadTimer = time.AfterFunc(certificateReloadDelay, reloader.reload)
+					} else {
+						reloader.reloadTimer.Reset(certificateReloadDelay)
+					}
+				}
+			}
+			certificateReloadersMu.Unlock()
+		case err, ok := <-certificatesWatcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("Certificates file watcher error", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Define a struct for a change made to the active servers, recording which server changed and what it was like before,
+// as the change itself is answered from the current state of the server
+type serverChange struct {
+	seq    uint64
+	name   string
+	before *Server
+}
+
+// Define a struct for a server that changed since a delta token, server being nil if it got removed and before being
+// nil if it got added
+type serverDelta struct {
+	seq    uint64
+	name   string
+	server *Server
+	before *Server
+}
+
+var (
+	serverChangesEpoch  = strconv.FormatInt(time.Now().UnixNano(), 36) // Tells tokens issued before we got restarted apart
+	serverChangeSeq     uint64                                         // Sequence number of the last change recorded
+	serverChangeLog     []serverChange                                 // The most recent changes, oldest first
+	serverChangesSignal = make(chan struct{})                          // Closed, and replaced, whenever a change gets recorded
+	serverChangeStates  = map[string]Server{}                          // The servers as of the last change recorded for them
+
+	errDeltaTokenExpired = errors.New("the delta token is invalid or has expired, please request the servers again")
+)
+
+// Record that a server got added, updated or removed, and wake up anyone waiting for changes. Callers need to hold mu
+// and need to have made the change to the active servers already.
+func recordServerChangeLocked(name string) {
+	change := serverChange{name: name}
+	if before, existed := serverChangeStates[name]; existed {
+		change.before = &before
+	}
+	if server, exists := activeServersByName[name]; exists {
+		serverChangeStates[name] = server
+	} else {
+		delete(serverChangeStates, name)
+	}
+	serverChangeSeq++
+	change.seq = serverChangeSeq
+	serverChangeLog = append(serverChangeLog, change)
+	if history := viper.GetInt("servers.changes.history"); len(serverChangeLog) > history {
+		serverChangeLog = append([]serverChange(nil), serverChangeLog[len(serverChangeLog)-history:]...)
+	}
+	close(serverChangesSignal)
+	serverChangesSignal = make(chan struct{})
+}
+
+// Returns the token for the changes up to and including the one with the sequence number
+func serverChangeToken(seq uint64) string {
+	return serverChangesEpoch + "." + strconv.FormatUint(seq, 10)
+}
+
+// Returns the sequence number of the last change included in the token
+func parseServerChangeToken(token string) (uint64, error) {
+	epoch, seq, found := strings.Cut(token, ".")
+	if !found || epoch != serverChangesEpoch {
+		return 0, errDeltaTokenExpired
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, errDeltaTokenExpired
+	}
+	return n, nil
+}
+
+// Returns the token to request the changes made to the servers from here on
+func currentServerChangeToken() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return serverChangeToken(serverChangeSeq)
+}
+
+// Returns the active servers along with the token to request the changes made to them from here on
+func trackServers(forceRefresh bool) ([]Server, string) {
+	// Answer from the servers as last polled unless explicitly asked to refresh them first
+	ensureServersRefreshed(forceRefresh)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	servers := []Server{}
+	for _, server := range activeServersByName {
+		servers = append(servers, server)
+	}
+	return servers, serverChangeToken(serverChangeSeq)
+}
+
+// Returns the servers added, updated or removed since the token, in the order they last changed, along with the token
+// for the changes from here on and the channel that gets closed once the next change is recorded
+func serverChangesSince(token string) ([]serverDelta, string, <-chan struct{}, error) {
+	since, err := parseServerChangeToken(token)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Tokens from the future, or older than the changes we kept, can't be answered
+	if since > serverChangeSeq || (since < serverChangeSeq && (len(serverChangeLog) == 0 || serverChangeLog[0].seq > since+1)) {
+		return nil, "", nil, errDeltaTokenExpired
+	}
+
+	// Servers that changed more than once are only reported once, as of their last change and compared to what they
+	// were like before their first change
+	first := map[string]*serverChange{}
+	last := map[string]uint64{}
+	for i, change := range serverChangeLog {
+		if change.seq > since {
+			if _, seen := first[change.name]; !seen {
+				first[change.name] = &serverChangeLog[i]
+			}
+			last[change.name] = change.seq
+		}
+	}
+	deltas := []serverDelta{}
+	for _, change := range serverChangeLog {
+		if change.seq <= since || last[change.name] != change.seq {
+			continue
+		}
+		delta := serverDelta{seq: change.seq, name: change.name, before: first[change.name].before}
+		if server, exists := activeServersByName[change.name]; exists {
+			delta.server = &server
+		}
+		deltas = append(deltas, delta)
+	}
+	return deltas, serverChangeToken(serverChangeSeq), serverChangesSignal, nil
+}
+
+// Returns true if the change concerns a client tracking the servers matching the query, which is the case if the server
+// matches it now, or did before and so is known to the client
+func (delta serverDelta) concerns(query *serverQuery) bool {
+	return (delta.server != nil && query.matches(delta.server)) || (delta.before != nil && query.matches(delta.before))
+}
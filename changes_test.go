@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestServerChangesConcernMatchingServersOnly(t *testing.T) {
+	viper.Set("servers.changes.history", 100)
+	t.Cleanup(func() { viper.Set("servers.changes.history", nil) })
+	query, qerr := parseServerQuery(url.Values{"$filter": {"startswith(Name,'Sales')"}}, true)
+	if qerr != nil {
+		t.Fatal(qerr)
+	}
+	setServer := func(name string, accepting bool) {
+		server := NewServer()
+		server.Name, server.AcceptingClients = name, accepting
+		activeServersByName[name] = server
+		recordServerChangeLocked(name)
+	}
+	removeServerEntry := func(name string) {
+		delete(activeServersByName, name)
+		recordServerChangeLocked(name)
+	}
+
+	mu.Lock()
+	setServer("SalesEU", true)
+	setServer("Planning", true)
+	mu.Unlock()
+	token := currentServerChangeToken()
+
+	mu.Lock()
+	setServer("SalesUS", true)   // Added, matching
+	setServer("Planning", false) // Changed, never matching
+	setServer("Budget", true)    // Added and removed again, never matching
+	removeServerEntry("Budget")
+	removeServerEntry("SalesEU") // Removed, matched before
+	setServer("SalesAPAC", true) // Added and removed again, only matching in between
+	removeServerEntry("SalesAPAC")
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, name := range []string{"SalesUS", "Planning"} {
+			removeServerEntry(name)
+		}
+	})
+
+	deltas, _, _, err := serverChangesSince(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := NewServersDeltaResponse(deltas, query, "")
+	expected := []string{"SalesUS", "SalesEU"}
+	if len(response.Servers) != len(expected) {
+		t.Fatalf("expected %d changes, got %v", len(expected), response.Servers)
+	}
+	for i, object := range response.Servers {
+		id := ""
+		for _, property := range object {
+			if property.Name == "@odata.id" || property.Name == "id" {
+				id, _ = property.Value.(string)
+			}
+		}
+		if id != "Servers('"+expected[i]+"')" {
+			t.Errorf("expected change %d to be for %s, got %v", i, expected[i], object)
+		}
+	}
+}
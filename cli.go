@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func printUsage(flags *flag.FlagSet) {
+	fmt.Fprintln(flags.Output(), "Usage: "+flags.Name()+" [--config <path>] [command]")
+	fmt.Fprintln(flags.Output(), `
+Commands:
+  serve                           Run the admin host, as a service or as a console application (default)
+  validate-config                 Check the configuration without starting the admin host
+  list-databases                  List the databases of the configured TM1 v12 service instances
+  ports show                      Show the ports assigned to servers in the port map
+  ports pin <server> <port>       Assign a port to a server in the port map, keeping it assigned for good
+  ports release <server>          Remove the port assigned to a server from the port map
+  service install [--name <n>]    Install the admin host as a service using the specified config file
+  service uninstall [--name <n>]  Uninstall the admin host service
+  help                            Show this help
+
+Options:`)
+	flags.PrintDefaults()
+}
+
+// Parse the options of a command, which may repeat the --config option
+func parseCommandFlags(command string, args []string, configFile *string) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.StringVar(configFile, "config", *configFile, "path of the config file (default ./config.json)")
+	flags.Parse(args)
+	return flags
+}
+
+// Set up logging to the console for commands, warnings and errors are counted so commands can report them
+func initCommandLogger(problems *int) {
+	// The level used by buildConfig is independent of the level the command logs at
+	loggerLevel = zap.NewAtomicLevel()
+
+	encoderConfig := zap.NewDevelopmentEncoderConfig()
+	encoderConfig.TimeKey = ""
+	core := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), zapcore.AddSync(os.Stderr), zap.InfoLevel)
+	logger = zap.New(core, zap.Hooks(func(entry zapcore.Entry) error {
+		if entry.Level >= zapcore.WarnLevel {
+			*problems++
+		}
+		return nil
+	}))
+}
+
+// Read and build the configuration for a command, returning false if the config file could not be read
+func loadCommandConfig(configFile string) bool {
+	if err := initConfig(configFile); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			logger.Debug("Config file not found, using default configuration")
+		} else {
+			logger.Error("Config file could not be read", zap.Error(err))
+			return false
+		}
+	}
+	if err := buildConfig(); err != nil {
+		logConfigErrors(err)
+		return false
+	}
+	return true
+}
+
+// Check the configuration, reporting every problem found rather than exiting on the first one
+func validateConfigCommand(configFile string) (exitCode int) {
+	problems := 0
+	initCommandLogger(&problems)
+	defer func() {
+		if exitCode == 0 && problems > 0 {
+			exitCode = 1
+		}
+		configuration := "Default configuration"
+		if viper.ConfigFileUsed() != "" {
+			configuration = "Configuration " + viper.ConfigFileUsed()
+		}
+		if exitCode == 0 {
+			fmt.Println(configuration + " is valid")
+		} else {
+			fmt.Println(configuration + " is not valid, " + strconv.Itoa(problems) + " problem(s) found")
+		}
+	}()
+	if !loadCommandConfig(configFile) {
+		return 1
+	}
+	return 0
+}
+
+// List the databases of every configured TM1 v12 service instance and the servers they are advertised as
+func listDatabasesCommand(configFile string) int {
+	problems := 0
+	initCommandLogger(&problems)
+	if !loadCommandConfig(configFile) {
+		return 1
+	}
+
+	exitCode := 0
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "INSTANCE\tDATABASE\tSERVER\tVERSION\tREPLICAS\tREADY\tADVERTISED")
+	instances := tm1Instances()
+	for i := range instances {
+		databases, err := listDatabases(&instances[i])
+		if err != nil {
+			logger.Error("Unable to list databases", zap.String("instance", instances[i].Name), zap.Error(err))
+			exitCode = 1
+			continue
+		}
+		for _, database := range databases {
+			ready := 0
+			for _, replica := range database.ActiveReplicas {
+				if replica.State == "ready" {
+					ready++
+				}
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%d\t%t\n", instances[i].Name, database.Name, instances[i].serverName(database.Name), database.ProductVersion.SemVer, database.Replicas, ready, instances[i].advertises(&database))
+		}
+	}
+	writer.Flush()
+	return exitCode
+}
+
+// Show or change the ports assigned to servers in the port map
+func portsCommand(args []string, configFile *string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: ports show | ports pin <server> <port> | ports release <server>")
+		return 2
+	}
+	subcommand := args[0]
+	flags := parseCommandFlags("ports "+subcommand, args[1:], configFile)
+	problems := 0
+	initCommandLogger(&problems)
+	if !loadCommandConfig(*configFile) {
+		return 1
+	}
+
+	switch {
+	case subcommand == "show" && flags.NArg() == 0:
+		entries, _, err := readPortMapFile()
+		if err != nil {
+			logger.Error("Unable to read port map", zap.String("file", portMapFilePath), zap.Error(err))
+			return 1
+		}
+		servers := []string{}
+		for server := range entries {
+			servers = append(servers, server)
+		}
+		sort.Slice(servers, func(i, j int) bool { return entries[servers[i]].Port < entries[servers[j]].Port })
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "PORT\tSERVER\tPINNED\tFIRST ASSIGNED\tLAST SEEN")
+		for _, server := range servers {
+			entry := entries[server]
+			fmt.Fprintf(writer, "%d\t%s\t%t\t%s\t%s\n", entry.Port, server, entry.Pinned, entry.FirstAssigned.Format(time.RFC3339), entry.LastSeen.Format(time.RFC3339))
+		}
+		writer.Flush()
+		return 0
+
+	case subcommand == "pin" && flags.NArg() == 2:
+		server := flags.Arg(0)
+		port, err := strconv.Atoi(flags.Arg(1))
+		if err != nil || port <= 0 || port > 65535 {
+			logger.Error("Invalid port specified", zap.String("port", flags.Arg(1)))
+			return 1
+		}
+		if !isAssignablePort(port) {
+			logger.Warn("Port is outside of the configured port ranges or excluded", zap.Int("port", port))
+		}
+		err = updatePortMapFile(func(entries map[string]*portMapEntry) error {
+			for other, entry := range entries {
+				if entry.Port == port && other != server {
+					return errors.New("port " + strconv.Itoa(port) + " is assigned to server '" + other + "' already, release it first")
+				}
+			}
+			now := time.Now().UTC()
+			if entry, exists := entries[server]; exists && entry.Port == port {
+				entry.Pinned = true
+			} else {
+				entries[server] = &portMapEntry{Port: port, FirstAssigned: now, LastSeen: now, Pinned: true}
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error("Unable to pin port", zap.String("file", portMapFilePath), zap.Error(err))
+			return 1
+		}
+
+	case subcommand == "release" && flags.NArg() == 1:
+		server := flags.Arg(0)
+		err := updatePortMapFile(func(entries map[string]*portMapEntry) error {
+			if _, exists := entries[server]; !exists {
+				return errors.New("no port assigned to server '" + server + "'")
+			}
+			delete(entries, server)
+			return nil
+		})
+		if err != nil {
+			logger.Error("Unable to release port", zap.String("file", portMapFilePath), zap.Error(err))
+			return 1
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: ports show | ports pin <server> <port> | ports release <server>")
+		return 2
+	}
+
+	logger.Info("Port map updated", zap.String("file", portMapFilePath))
+	return 0
+}
+
+// Install or uninstall the admin host as a service
+func serviceCommand(args []string, configFile *string) int {
+	if len(args) == 0 || (args[0] != "install" && args[0] != "uninstall") {
+		fmt.Fprintln(os.Stderr, "Usage: service install [--name <name>] | service uninstall [--name <name>]")
+		return 2
+	}
+	subcommand := args[0]
+	var name string
+	flags := flag.NewFlagSet("service "+subcommand, flag.ExitOnError)
+	flags.StringVar(configFile, "config", *configFile, "path of the config file (default ./config.json)")
+	flags.StringVar(&name, "name", "", "name of the service (default admsrv.service-name from the config file)")
+	flags.Parse(args[1:])
+
+	problems := 0
+	initCommandLogger(&problems)
+	if !loadCommandConfig(*configFile) {
+		return 1
+	}
+	if name == "" {
+		name = viper.GetString("admsrv.service-name")
+	}
+
+	// The service needs to be able to find the config file regardless of the directory it gets started in
+	configPath := *configFile
+	if configPath == "" {
+		configPath = "config.json"
+	}
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		logger.Error("Unable to determine path of config file", zap.Error(err))
+		return 1
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		logger.Error("Unable to determine path of executable", zap.Error(err))
+		return 1
+	}
+
+	if subcommand == "install" {
+		err = installService(name, executable, configPath)
+	} else {
+		err = uninstallService(name)
+	}
+	if err != nil {
+		logger.Error("Unable to "+subcommand+" service", zap.String("service", name), zap.Error(err))
+		return 1
+	}
+	logger.Info("Service "+subcommand+"ed", zap.String("service", name))
+	return 0
+}
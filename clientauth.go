@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Client certificate authentication modes of the server proxies
+const (
+	clientAuthNone    = "none"    // Client certificates are neither requested nor verified
+	clientAuthRequest = "request" // Client certificates are requested and verified if the client sends one
+	clientAuthRequire = "require" // Client certificates are required and verified
+)
+
+// Certificate revocation list, re-read whenever the file changed
+type revocationList struct {
+	file    string
+	mu      sync.Mutex
+	modTime time.Time
+	list    *x509.RevocationList
+	revoked map[string]bool
+}
+
+var (
+	revocationLists   = map[string]*revocationList{}
+	revocationListsMu sync.Mutex
+)
+
+// Returns the revocation list for a file, loading it if this is the first proxy using it
+func revocationListFor(file string) (*revocationList, error) {
+	revocationListsMu.Lock()
+	defer revocationListsMu.Unlock()
+
+	file, _ = filepath.Abs(file)
+	if crl, exists := revocationLists[file]; exists {
+		return crl, nil
+	}
+	crl := &revocationList{file: file}
+	if err := crl.refresh(); err != nil {
+		return nil, err
+	}
+	revocationLists[file] = crl
+	return crl, nil
+}
+
+// Re-read the revocation list if the file changed since we last read it. Callers need to hold crl.mu, or be the
+// only one holding a reference to it.
+func (crl *revocationList) refresh() error {
+	info, err := os.Stat(crl.file)
+	if err != nil {
+		return err
+	}
+	if crl.list != nil && info.ModTime().Equal(crl.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(crl.file)
+	if err != nil {
+		return err
+	}
+
+	// Revocation lists come either PEM or DER encoded
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return err
+	}
+	revoked := map[string]bool{}
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	if !list.NextUpdate.IsZero() && time.Now().After(list.NextUpdate) {
+		logger.Warn("Certificate revocation list is out of date, please update it", zap.String("crl-file", crl.file), zap.Time("next-update", list.NextUpdate))
+	}
+	logger.Info("Certificate revocation list loaded", zap.String("crl-file", crl.file), zap.String("issuer", list.Issuer.String()), zap.Int("revoked", len(revoked)))
+	crl.modTime = info.ModTime()
+	crl.list = list
+	crl.revoked = revoked
+	return nil
+}
+
+// Returns an error if the certificate got revoked by the issuer of the revocation list
+func (crl *revocationList) check(certificate *x509.Certificate, issuer *x509.Certificate) error {
+	crl.mu.Lock()
+	defer crl.mu.Unlock()
+
+	// Keep using the revocation list we have if the changed one can't be read, it is likely being written
+	if err := crl.refresh(); err != nil {
+		logger.Warn("Unable to refresh certificate revocation list, continuing to use the current list", zap.Error(err), zap.String("crl-file", crl.file))
+	}
+	if crl.list.CheckSignatureFrom(issuer) != nil {
+		return nil
+	}
+	if crl.revoked[certificate.SerialNumber.String()] {
+		return errors.New("client certificate " + certificate.SerialNumber.Text(16) + " has been revoked")
+	}
+	return nil
+}
+
+// Add client certificate verification to the TLS configuration of a server proxy, as configured
+func configureClientAuth(tlsConfig *tls.Config) error {
+	mode := viper.GetString("servers.client-auth.mode")
+	if mode == clientAuthNone {
+		return nil
+	}
+
+	// Client certificates need to be issued by one of the certificate authorities in the bundle
+	caFile := viper.GetString("servers.client-auth.ca-file")
+	caData, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		return errors.New("no certificates found in certificate authority file " + caFile)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if mode == clientAuthRequire {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	// Reject client certificates that have been revoked, if we have been given a revocation list
+	if crlFile := viper.GetString("servers.client-auth.crl-file"); crlFile != "" {
+		crl, err := revocationListFor(crlFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for i := 0; i+1 < len(chain); i++ {
+					if err := crl.check(chain[i], chain[i+1]); err != nil {
+						logger.Warn("Client certificate rejected", zap.Error(err), zap.String("subject", chain[0].Subject.String()))
+						return err
+					}
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// Returns the identity of the client as presented in its certificate, if it presented one that got verified
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	certificate := r.TLS.VerifiedChains[0][0]
+	switch viper.GetString("servers.client-auth.identity-attribute") {
+	case "common-name":
+		return certificate.Subject.CommonName
+	case "email":
+		if len(certificate.EmailAddresses) > 0 {
+			return certificate.EmailAddresses[0]
+		}
+		return ""
+	default:
+		return certificate.Subject.String()
+	}
+}
+
+// Forward the identity of the client, taken from its certificate, to the upstream in the identity header, if one is
+// configured. Whatever the client sent in that header itself never makes it upstream.
+func withClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := viper.GetString("servers.client-auth.identity-header")
+		if header != "" {
+			r.Header.Del(header)
+			if identity := clientIdentity(r); identity != "" {
+				r.Header.Set(header, identity)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Populate the SSL properties of a server from the certificate it is being served with and the client certificate
+// authentication settings, so they are consistent with what v11 clients would get from a v11 server. Returns true if
+// any of the properties changed.
+func setServerSSLProperties(server *Server) bool {
+	before := *server
+	server.SSLCertificateID = ""
+	server.SSLCertificateAuthority = ""
+	server.SSLCertificateRevocationList = ""
+	server.ClientExportSSLSvrCert = false
+	server.ClientExportSSLSvrKeyID = ""
+	if server.UsingSSL {
+		if reloader, err := certificateFor(viper.GetString("servers.cert-file"), viper.GetString("servers.key-file")); err == nil {
+			certificate, _ := reloader.getCertificate(nil)
+			server.SSLCertificateID = NullableString(certificate.Leaf.Subject.CommonName)
+			server.SSLCertificateAuthority = NullableString(certificate.Leaf.Issuer.CommonName)
+		}
+		if crlFile := viper.GetString("servers.client-auth.crl-file"); crlFile != "" && viper.GetString("servers.client-auth.mode") != clientAuthNone {
+			server.SSLCertificateRevocationList = NullableString(filepath.Base(crlFile))
+		}
+		server.ClientExportSSLSvrCert = viper.GetBool("servers.client-export-ssl-svr-cert")
+		server.ClientExportSSLSvrKeyID = NullableString(viper.GetString("servers.client-export-ssl-svr-key-id"))
+	}
+	return *server != before
+}
@@ -1,32 +1,96 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"net"
+	"net/url"
+	"os"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
-func initConfig() error {
+var (
+	configReloadMu    sync.Mutex
+	appliedConfigData = []byte("{}") // Contents of the config file last applied, none if we run on the defaults
+)
+
+func initConfig(configFile string) error {
 	// Set up configuration (Viper)
-	viper.SetConfigName("config") // Name of config file (without extension)
-	viper.SetConfigType("json")   // Specify the format (e.g., JSON, YAML)
-	viper.AddConfigPath(".")      // Look for config in the current directory
+	viper.SetConfigType("json") // Specify the format (e.g., JSON, YAML)
+	if configFile != "" {
+		viper.SetConfigFile(configFile) // Use the config file specified on the command line
+	} else {
+		viper.SetConfigName("config") // Name of config file (without extension)
+		viper.AddConfigPath(".")      // Look for config in the current directory
+	}
 
 	// Set default values
-	viper.SetDefault("admsrv.service-name", "tm1-v12-admsrv") // The name used for the windows service
+	viper.SetDefault("admsrv.service-name", "tm1-v12-admsrv") // The name used for the windows/systemd service
 	viper.SetDefault("admsrv.http-port", 5895)                // HTTP port for the admin host to listen on
 	viper.SetDefault("admsrv.https-port", 5898)               // HTTPS port for the admin host to listen on
 	viper.SetDefault("admsrv.cert-file", "./cert.pem")        // Path to SSL certificate file
 	viper.SetDefault("admsrv.key-file", "./key.pem")          // Path to SSL key file
+	viper.SetDefault("admsrv.auth.api-keys", []string{})      // API keys, either plain keys granting the admin role or objects with a key, name and role
+
+	viper.SetDefault("admsrv.auth.anonymous-read", true)    // Boolean indicating if clients without credentials get the reader role
+	viper.SetDefault("admsrv.auth.htpasswd-file", nil)      // Path to the htpasswd file, with bcrypt or SHA-1 hashes, used for basic authentication
+	viper.SetDefault("admsrv.auth.jwks-file", nil)          // Path to the JSON web key set used to verify bearer tokens
+	viper.SetDefault("admsrv.auth.jwt.issuer", nil)         // The issuer bearer tokens need to be issued by, if specified
+	viper.SetDefault("admsrv.auth.jwt.audience", nil)       // The audience bearer tokens need to be issued for, if specified
+	viper.SetDefault("admsrv.auth.jwt.name-claim", "sub")   // The claim holding the name of the user
+	viper.SetDefault("admsrv.auth.jwt.role-claim", "roles") // The claim holding the role(s) of the user, users without one get their role from users
+	viper.SetDefault("admsrv.auth.jwt.leeway", "60s")       // How much the clocks of the issuer and this host may differ
+	viper.SetDefault("admsrv.auth.users", []interface{}{})  // The roles of users, each with a name and role, authenticated with a password or bearer token
+	viper.SetDefault("admsrv.auth.default-role", "reader")  // The role of authenticated users not given one otherwise (none, reader, operator or admin)
+	viper.SetDefault("admsrv.auth.routes", []interface{}{}) // The role required for routes, each with a method, path pattern and role, on top of the built-in ones
 
 	viper.SetDefault("tm1-v12.databases-url", "http://localhost:4444/tm1/api/v1/Databases") // TM1 v12 databases collection URL
 	viper.SetDefault("tm1-v12.database-url-template", nil)                                  // TM1 v12 database URL template (default: "<<databases-url>>('{{.database}}')")
 	viper.SetDefault("tm1-v12.auth.basic.username", nil)                                    // The user name of the user logging in
 	viper.SetDefault("tm1-v12.auth.basic.password", nil)                                    // The password of the user logging in
+	viper.SetDefault("tm1-v12.auth.bearer.token", nil)                                      // A static bearer token, used instead of basic authentication
+	viper.SetDefault("tm1-v12.auth.oauth2.token-url", nil)                                  // The token endpoint, if specified the client credentials grant is used instead of basic authentication
+	viper.SetDefault("tm1-v12.auth.oauth2.client-id", nil)                                  // The client ID used to request a token
+	viper.SetDefault("tm1-v12.auth.oauth2.client-secret", nil)                              // The client secret used to request a token
+	viper.SetDefault("tm1-v12.auth.oauth2.scopes", []string{})                              // The scopes to request
+	viper.SetDefault("tm1-v12.auth.oauth2.audience", nil)                                   // The audience to request the token for, if any
+	viper.SetDefault("tm1-v12.auth.oauth2.client-auth-method", "basic")                     // How the client authenticates with the token endpoint (basic or post)
+	viper.SetDefault("tm1-v12.auth.oauth2.refresh-before", "60s")                           // How long before it expires a token gets refreshed
+	viper.SetDefault("tm1-v12.replica-url-template", nil)                                   // TM1 v12 replica URL template (as in "<<databases-url>>('{{database}}')/Replicas('{{replica}}')"), enables balancing requests across replicas
+	viper.SetDefault("tm1-v12.writer-role", "primary")                                      // The role of the replica to which all writes get forwarded
+	viper.SetDefault("tm1-v12.name-prefix", nil)                                            // Prefix added to the database name to form the server name
+	viper.SetDefault("tm1-v12.name-suffix", nil)                                            // Suffix added to the database name to form the server name
+	viper.SetDefault("tm1-v12.include", []interface{}{})                                    // Rules, as in [{"name": "", "product-version": "", "replica-state": ""}], databases need to match one of to be advertised
+	viper.SetDefault("tm1-v12.exclude", []interface{}{})                                    // Rules, as in [{"name": "Scratch*"}], databases matching any of are not advertised
+	viper.SetDefault("tm1-v12.aliases", []interface{}{})                                    // Aliases, as in [{"database": "", "server": ""}], advertising databases under another server name
+	viper.SetDefault("tm1-v12.instances", []interface{}{})                                  // Multiple TM1 v12 service instances, each with a name, databases-url, database-url-template, name-prefix, name-suffix, include, exclude, aliases and auth, used instead of the settings above
+	viper.SetDefault("tm1-v12.poll.interval", "15s")                                        // Interval at which the databases are polled
+	viper.SetDefault("tm1-v12.poll.jitter", "2s")                                           // Maximum random delay added to every poll interval
+	viper.SetDefault("tm1-v12.poll.max-backoff", "5m")                                      // Maximum interval between polls when polling keeps failing
+
+	viper.SetDefault("tm1-v12.tls.ca-file", nil)                        // Path to the bundle of certificate authorities trusted on top of the system ones
+	viper.SetDefault("tm1-v12.tls.cert-file", nil)                      // Path to the client certificate file presented to TM1 v12, if any
+	viper.SetDefault("tm1-v12.tls.key-file", nil)                       // Path to the key file of the client certificate
+	viper.SetDefault("tm1-v12.tls.server-name", nil)                    // Name the certificate of TM1 v12 is verified against, instead of the host name
+	viper.SetDefault("tm1-v12.tls.insecure-skip-verify", false)         // Boolean indicating the certificate of TM1 v12 is not verified (testing only!)
+	viper.SetDefault("tm1-v12.transport.dial-timeout", "10s")           // Maximum time connecting to TM1 v12 may take
+	viper.SetDefault("tm1-v12.transport.keep-alive", "30s")             // Interval between keep-alive probes on connections to TM1 v12
+	viper.SetDefault("tm1-v12.transport.tls-handshake-timeout", "10s")  // Maximum time the TLS handshake with TM1 v12 may take
+	viper.SetDefault("tm1-v12.transport.response-header-timeout", "0s") // Maximum time to wait for the response headers, 0 for none as processes may run for hours
+	viper.SetDefault("tm1-v12.transport.expect-continue-timeout", "1s") // Maximum time to wait for a 100-continue response
+	viper.SetDefault("tm1-v12.transport.idle-conn-timeout", "90s")      // How long an idle connection is kept open
+	viper.SetDefault("tm1-v12.transport.max-idle-conns", 100)           // Maximum number of idle connections, 0 for no limit
+	viper.SetDefault("tm1-v12.transport.max-idle-conns-per-host", 16)   // Maximum number of idle connections per host
+	viper.SetDefault("tm1-v12.transport.max-conns-per-host", 0)         // Maximum number of connections per host, 0 for no limit
+	viper.SetDefault("tm1-v12.transport.http2", true)                   // Boolean indicating if HTTP/2 is used when TM1 v12 supports it
 
 	viper.SetDefault("servers.host-name", "localhost")  // The host name returned as the Host in every server entity ("" => null)
 	viper.SetDefault("servers.ip-v4-address", nil)      // The IP v4 address returned in every server entity ("" => null)
@@ -37,39 +101,114 @@ func initConfig() error {
 	viper.SetDefault("servers.cert-file", "./cert.pem") // Path to SSL certificate file used by the reverse proxy
 	viper.SetDefault("servers.key-file", "./key.pem")   // Path to SSL key file used by the reverse proxy
 
+	viper.SetDefault("servers.port-ranges", []interface{}{})  // Multiple port ranges, as in [{"min": 9601, "max": 9659}], used instead of the port range above
+	viper.SetDefault("servers.excluded-ports", []int{})       // Ports in the port ranges that are never assigned to a server
+	viper.SetDefault("servers.pinned-ports", []interface{}{}) // Ports pinned to servers, as in [{"server": "Planning Sample", "port": 12354}], never assigned to other servers
+	viper.SetDefault("servers.strict-ports", false)           // Boolean indicating a server doesn't accept clients, rather than being served on another port, while its pinned port is not available
+
+	viper.SetDefault("servers.client-export-ssl-svr-cert", false)         // Boolean advertised to clients indicating they should export the certificate authority certificate from the Windows certificate store
+	viper.SetDefault("servers.client-export-ssl-svr-key-id", nil)         // The identity key advertised to clients to export the certificate authority certificate with
+	viper.SetDefault("servers.client-auth.mode", "none")                  // Client certificate authentication (none, request or require)
+	viper.SetDefault("servers.client-auth.ca-file", nil)                  // Path to the bundle of certificate authorities client certificates need to be issued by
+	viper.SetDefault("servers.client-auth.crl-file", nil)                 // Path to the certificate revocation list client certificates are checked against, if any
+	viper.SetDefault("servers.client-auth.identity-header", nil)          // Header in which the identity of the client is forwarded to TM1 v12, if any
+	viper.SetDefault("servers.client-auth.identity-attribute", "subject") // Attribute of the client certificate forwarded as the identity (subject, common-name or email)
+
+	viper.SetDefault("servers.registered-file", "./registered-servers.json") // File in which manually registered servers are persisted
+	viper.SetDefault("servers.port-map.gc-after", "2160h")                   // How long the port of a server not seen in the meantime remains assigned to it, 0 to keep it forever
+	viper.SetDefault("servers.session-affinity-timeout", "1h")               // How long a session remains pinned to a replica after it was last used
+	viper.SetDefault("servers.configuration-cache-ttl", "5m")                // How long the configuration of a database is cached for the internal configuration endpoint
+	viper.SetDefault("servers.capabilities-cache-ttl", "5m")                 // How long the capabilities of a session are cached for the internal capabilities endpoint
+
+	viper.SetDefault("servers.changes.history", 1000)     // How many changes to the servers are kept to answer delta and event stream requests
+	viper.SetDefault("servers.changes.keep-alive", "15s") // How often a comment is sent on an idle event stream so it isn't closed by proxies
+
+	viper.SetDefault("pa-proxy.enabled", false)          // Boolean indicating if the PA proxy should be started
+	viper.SetDefault("pa-proxy.target-url", nil)         // The URL requests not matching any of the routes are forwarded to
+	viper.SetDefault("pa-proxy.port", 5555)              // The port the PA proxy listens on
+	viper.SetDefault("pa-proxy.using-ssl", false)        // Boolean indicating if we expect our clients to use SSL
+	viper.SetDefault("pa-proxy.cert-file", "./cert.pem") // Path to SSL certificate file used by the PA proxy
+	viper.SetDefault("pa-proxy.key-file", "./key.pem")   // Path to SSL key file used by the PA proxy
+	viper.SetDefault("pa-proxy.routes", []interface{}{}) // Routes, as in [{"path-prefix": "/", "target-url": "", "strip-prefix": false}], forwarding to other back ends
+
+	viper.SetDefault("metrics.enabled", true)    // Boolean indicating if metrics are exposed in the Prometheus format
+	viper.SetDefault("metrics.port", 0)          // Port on which metrics are served, 0 to serve them on the admin listener(s)
+	viper.SetDefault("metrics.path", "/metrics") // Path on which metrics are served
+
+	viper.SetDefault("certificates.expiry-warning-days", 30) // Number of days before a certificate expires we start warning about it
+
+	viper.SetDefault("shutdown.drain-timeout", "30s") // How long requests in flight get to finish when shutting down
+	viper.SetDefault("shutdown.retry-after", "30s")   // Retry-After returned with requests rejected while shutting down
+
 	viper.SetDefault("log.file", "./tm1-v12-admsrv.log") // Log file name
 	viper.SetDefault("log.level", "info")                // Log level (fatal, error, warning, info and debug)
 
-	// Watch the config file and re-read it on change
+	// Read the config file, remembering what it contained so we can go back to it should a reloaded one be invalid
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return err
+	}
+	appliedConfigData = data
+	return nil
+}
+
+// Watch the config file and re-read it on change
+func watchConfig() {
 	viper.OnConfigChange(func(e fsnotify.Event) {
-		err := viper.ReadInConfig()
-		if err != nil {
-			if logger != nil {
-				logger.Error("Unable to reload configuration", zap.Error(err))
-			}
-		} else {
-			if logger != nil {
-				logger.Info("Configuration reloaded")
-			}
-			buildConfig()
-		}
+		reloadConfig()
 	})
 	viper.WatchConfig()
+}
 
-	// Read the config file
-	err := viper.ReadInConfig()
+// Re-read the config file and apply the changes, called whenever the config file changed or a reload was requested.
+// A config file that can't be read or has problems is not applied, we keep running with the previous configuration.
+func reloadConfig() {
+	if logger == nil {
+		return
+	}
+	configReloadMu.Lock()
+	defer configReloadMu.Unlock()
+	data, err := os.ReadFile(viper.ConfigFileUsed())
+	if err == nil {
+		err = viper.ReadConfig(bytes.NewReader(data))
+	}
 	if err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			// First time running this service? Create config file with default values
-			viper.SafeWriteConfig()
-		} else {
-			return err
-		}
+		logger.Error("Unable to reload configuration, continuing to use the previous configuration", zap.Error(err))
+		restoreAppliedConfig()
+		return
+	}
+	if err := buildConfig(); err != nil {
+		logConfigErrors(err)
+		logger.Error("Configuration not reloaded, please correct the problems reported, continuing to use the previous configuration")
+		restoreAppliedConfig()
+		return
+	}
+	appliedConfigData = data
+	logger.Info("Configuration reloaded")
+
+	// Restart the PA proxy if its configuration changed
+	reloadPAReverseProxy()
+}
+
+// Go back to the config file contents last applied, building the configuration from them once more to undo whatever
+// the rejected configuration changed already
+func restoreAppliedConfig() {
+	if err := viper.ReadConfig(bytes.NewReader(appliedConfigData)); err != nil {
+		logger.Error("Unable to restore previous configuration", zap.Error(err))
+		return
+	}
+	if err := buildConfig(); err != nil {
+		logConfigErrors(err)
 	}
-	return nil
 }
 
-func buildConfig() {
+// Build and validate the configuration, returning every problem found that we can't fall back to a default for
+func buildConfig() error {
+	var errs []error
+
 	// Update the log level
 	switch viper.GetString("log.level") {
 	case "fatal":
@@ -114,28 +253,271 @@ func buildConfig() {
 		viper.Set("servers.ip-v4-address$", viper.GetString("servers.ip-v4-address"))
 	}
 
+	// Build the list of TM1 v12 service instances, using the top level settings if no instances are specified
+	var instances []tm1Instance
+	if err := viper.UnmarshalKey("tm1-v12.instances", &instances); err != nil {
+		errs = append(errs, newConfigError("Invalid TM1 v12 instances specified", zap.Error(err)))
+		instances = nil
+	} else if len(instances) == 0 {
+		instance := tm1Instance{
+			DatabasesURL:        viper.GetString("tm1-v12.databases-url"),
+			DatabaseURLTemplate: viper.GetString("tm1-v12.database-url-template"),
+			ReplicaURLTemplate:  viper.GetString("tm1-v12.replica-url-template"),
+			WriterRole:          viper.GetString("tm1-v12.writer-role"),
+			NamePrefix:          viper.GetString("tm1-v12.name-prefix"),
+			NameSuffix:          viper.GetString("tm1-v12.name-suffix"),
+		}
+		if err := viper.UnmarshalKey("tm1-v12.include", &instance.Include); err != nil {
+			errs = append(errs, newConfigError("Invalid database include rules specified", zap.Error(err)))
+		}
+		if err := viper.UnmarshalKey("tm1-v12.exclude", &instance.Exclude); err != nil {
+			errs = append(errs, newConfigError("Invalid database exclude rules specified", zap.Error(err)))
+		}
+		if err := viper.UnmarshalKey("tm1-v12.aliases", &instance.Aliases); err != nil {
+			errs = append(errs, newConfigError("Invalid database aliases specified", zap.Error(err)))
+		}
+		instance.Auth.Basic.Username = viper.GetString("tm1-v12.auth.basic.username")
+		instance.Auth.Basic.Password = viper.GetString("tm1-v12.auth.basic.password")
+		instance.Auth.Bearer.Token = viper.GetString("tm1-v12.auth.bearer.token")
+		instance.Auth.OAuth2 = oauth2Config{
+			TokenURL:         viper.GetString("tm1-v12.auth.oauth2.token-url"),
+			ClientID:         viper.GetString("tm1-v12.auth.oauth2.client-id"),
+			ClientSecret:     viper.GetString("tm1-v12.auth.oauth2.client-secret"),
+			Scopes:           viper.GetStringSlice("tm1-v12.auth.oauth2.scopes"),
+			Audience:         viper.GetString("tm1-v12.auth.oauth2.audience"),
+			ClientAuthMethod: viper.GetString("tm1-v12.auth.oauth2.client-auth-method"),
+			RefreshBefore:    viper.GetString("tm1-v12.auth.oauth2.refresh-before"),
+		}
+		instances = append(instances, instance)
+	} else {
+		// Every instance needs a unique name, and should be given a unique prefix or suffix
+		names := map[string]bool{}
+		affixes := map[string]string{}
+		for _, instance := range instances {
+			if instance.Name == "" || names[instance.Name] {
+				errs = append(errs, newConfigError("Invalid TM1 v12 instances specified: every instance requires a unique name", zap.String("name", instance.Name)))
+				continue
+			}
+			names[instance.Name] = true
+			affix := instance.NamePrefix + "\x00" + instance.NameSuffix
+			if other, exists := affixes[affix]; exists {
+				logger.Warn("TM1 v12 instances share the same name prefix and suffix, databases with the same name will only be advertised once", zap.String("instance", instance.Name), zap.String("other-instance", other))
+			}
+			affixes[affix] = instance.Name
+		}
+	}
+	for i := range instances {
+		if err := validateTM1Instance(&instances[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	viper.Set("tm1-v12.instances$", instances)
+
+	// Valid the port range specified
+	portMin := viper.GetInt("servers.port-range.min")
+	portMax := viper.GetInt("servers.port-range.max")
+	if portMin <= 0 || portMax > 65535 || portMin > portMax {
+		logger.Error("No valid port range specified! Falling back to using default port range [9601:9659]!", zap.Int("servers.port-range.min", portMin), zap.Int("servers.port-range.max", portMax))
+		viper.Set("servers.port-range.min", nil)
+		viper.Set("servers.port-range.max", nil)
+	}
+
+	// Build the ports assigned to servers from the port ranges, excluded and pinned ports
+	if err := buildPortConfig(); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Validate how long sessions remain pinned to a replica
+	if viper.GetDuration("servers.session-affinity-timeout") <= 0 {
+		logger.Error("No valid session affinity timeout specified! Falling back to using default timeout of 1h!", zap.String("servers.session-affinity-timeout", viper.GetString("servers.session-affinity-timeout")))
+		viper.Set("servers.session-affinity-timeout", nil)
+	}
+
+	// Validate how long the configuration of a database is cached
+	if viper.GetDuration("servers.configuration-cache-ttl") <= 0 {
+		logger.Error("No valid configuration cache TTL specified! Falling back to using default TTL of 5m!", zap.String("servers.configuration-cache-ttl", viper.GetString("servers.configuration-cache-ttl")))
+		viper.Set("servers.configuration-cache-ttl", nil)
+	}
+
+	// Validate how long the capabilities of a session are cached
+	if viper.GetDuration("servers.capabilities-cache-ttl") <= 0 {
+		logger.Error("No valid capabilities cache TTL specified! Falling back to using default TTL of 5m!", zap.String("servers.capabilities-cache-ttl", viper.GetString("servers.capabilities-cache-ttl")))
+		viper.Set("servers.capabilities-cache-ttl", nil)
+	}
+
+	// Validate the change tracking settings
+	if viper.GetInt("servers.changes.history") <= 0 {
+		logger.Error("No valid change history size specified! Falling back to keeping the last 1000 changes!", zap.Int("servers.changes.history", viper.GetInt("servers.changes.history")))
+		viper.Set("servers.changes.history", nil)
+	}
+	if viper.GetDuration("servers.changes.keep-alive") <= 0 {
+		logger.Error("No valid event stream keep-alive interval specified! Falling back to using default interval of 15s!", zap.String("servers.changes.keep-alive", viper.GetString("servers.changes.keep-alive")))
+		viper.Set("servers.changes.keep-alive", nil)
+	}
+
+	// Validate the polling settings
+	pollInterval := viper.GetDuration("tm1-v12.poll.interval")
+	if pollInterval <= 0 {
+		logger.Error("No valid poll interval specified! Falling back to using default poll interval of 15s!", zap.String("tm1-v12.poll.interval", viper.GetString("tm1-v12.poll.interval")))
+		viper.Set("tm1-v12.poll.interval", nil)
+	}
+	if viper.GetDuration("tm1-v12.poll.jitter") < 0 {
+		logger.Error("No valid poll jitter specified! Falling back to using default poll jitter of 2s!", zap.String("tm1-v12.poll.jitter", viper.GetString("tm1-v12.poll.jitter")))
+		viper.Set("tm1-v12.poll.jitter", nil)
+	}
+	if viper.GetDuration("tm1-v12.poll.max-backoff") < viper.GetDuration("tm1-v12.poll.interval") {
+		logger.Error("No valid maximum poll backoff specified! Falling back to using default maximum backoff of 5m!", zap.String("tm1-v12.poll.max-backoff", viper.GetString("tm1-v12.poll.max-backoff")))
+		viper.Set("tm1-v12.poll.max-backoff", nil)
+	}
+
+	// Validate the shutdown settings
+	if viper.GetDuration("shutdown.drain-timeout") <= 0 {
+		logger.Error("No valid drain timeout specified! Falling back to using default drain timeout of 30s!", zap.String("shutdown.drain-timeout", viper.GetString("shutdown.drain-timeout")))
+		viper.Set("shutdown.drain-timeout", nil)
+	}
+	if viper.GetDuration("shutdown.retry-after") < time.Second {
+		logger.Error("No valid retry after specified! Falling back to using default retry after of 30s!", zap.String("shutdown.retry-after", viper.GetString("shutdown.retry-after")))
+		viper.Set("shutdown.retry-after", nil)
+	}
+
+	// Validate the port map settings
+	if viper.GetDuration("servers.port-map.gc-after") < 0 {
+		logger.Error("No valid port map garbage collection period specified! Falling back to using default of 2160h!", zap.String("servers.port-map.gc-after", viper.GetString("servers.port-map.gc-after")))
+		viper.Set("servers.port-map.gc-after", nil)
+	}
+
+	// Validate the settings of the transport used for all requests to TM1 v12 and start using it
+	for _, key := range []string{"tm1-v12.transport.dial-timeout", "tm1-v12.transport.keep-alive", "tm1-v12.transport.tls-handshake-timeout", "tm1-v12.transport.response-header-timeout", "tm1-v12.transport.expect-continue-timeout", "tm1-v12.transport.idle-conn-timeout"} {
+		if viper.GetDuration(key) < 0 {
+			logger.Error("No valid timeout specified! Falling back to using default!", zap.String(key, viper.GetString(key)))
+			viper.Set(key, nil)
+		}
+	}
+	for _, key := range []string{"tm1-v12.transport.max-idle-conns", "tm1-v12.transport.max-idle-conns-per-host", "tm1-v12.transport.max-conns-per-host"} {
+		if viper.GetInt(key) < 0 {
+			logger.Error("No valid connection limit specified! Falling back to using default!", zap.Int(key, viper.GetInt(key)))
+			viper.Set(key, nil)
+		}
+	}
+	if (viper.GetString("tm1-v12.tls.cert-file") == "") != (viper.GetString("tm1-v12.tls.key-file") == "") {
+		errs = append(errs, newConfigError("Invalid TM1 v12 client certificate specified: both a certificate and a key file are required", zap.String("tm1-v12.tls.cert-file", viper.GetString("tm1-v12.tls.cert-file")), zap.String("tm1-v12.tls.key-file", viper.GetString("tm1-v12.tls.key-file"))))
+	}
+	if err := configureUpstreamTransport(); err != nil {
+		errs = append(errs, newConfigError("Invalid TM1 v12 TLS settings specified", zap.Error(err), zap.String("tm1-v12.tls.ca-file", viper.GetString("tm1-v12.tls.ca-file")), zap.String("tm1-v12.tls.cert-file", viper.GetString("tm1-v12.tls.cert-file"))))
+	}
+
+	// Validate the client certificate authentication settings
+	switch viper.GetString("servers.client-auth.mode") {
+	case clientAuthNone:
+	case clientAuthRequest, clientAuthRequire:
+		if viper.GetString("servers.client-auth.ca-file") == "" {
+			errs = append(errs, newConfigError("No certificate authority file specified, required to verify client certificates", zap.String("servers.client-auth.mode", viper.GetString("servers.client-auth.mode"))))
+		}
+	default:
+		errs = append(errs, newConfigError("Invalid client certificate authentication mode specified, please specify none, request or require", zap.String("servers.client-auth.mode", viper.GetString("servers.client-auth.mode"))))
+	}
+	switch viper.GetString("servers.client-auth.identity-attribute") {
+	case "subject", "common-name", "email":
+	default:
+		logger.Error("Unknown client identity attribute, please specify subject, common-name or email, defaulting to subject", zap.String("servers.client-auth.identity-attribute", viper.GetString("servers.client-auth.identity-attribute")))
+		viper.Set("servers.client-auth.identity-attribute", nil)
+	}
+
+	// Validate the certificate settings
+	if viper.GetInt("certificates.expiry-warning-days") < 0 {
+		logger.Error("No valid number of days to warn before certificates expire specified! Falling back to using default of 30 days!", zap.Int("certificates.expiry-warning-days", viper.GetInt("certificates.expiry-warning-days")))
+		viper.Set("certificates.expiry-warning-days", nil)
+	}
+
+	// Validate the metrics settings
+	metricsPort := viper.GetInt("metrics.port")
+	if metricsPort < 0 || metricsPort > 65535 {
+		logger.Error("No valid metrics port specified! Falling back to serving metrics on the admin listener(s)!", zap.Int("metrics.port", metricsPort))
+		viper.Set("metrics.port", nil)
+	}
+	if !strings.HasPrefix(viper.GetString("metrics.path"), "/") {
+		logger.Error("No valid metrics path specified! Falling back to using default path /metrics!", zap.String("metrics.path", viper.GetString("metrics.path")))
+		viper.Set("metrics.path", nil)
+	}
+
+	// Validate how much the clocks of the issuer of bearer tokens and this host may differ
+	if viper.GetDuration("admsrv.auth.jwt.leeway") < 0 {
+		logger.Error("No valid leeway specified! Falling back to using default leeway of 60s!", zap.String("admsrv.auth.jwt.leeway", viper.GetString("admsrv.auth.jwt.leeway")))
+		viper.Set("admsrv.auth.jwt.leeway", nil)
+	}
+
+	// Build the authentication settings of the admin listener, after the metrics settings as they apply to those too
+	if err := buildAdminAuthConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Define an error for a problem with the configuration, carrying the fields to log it with
+type configError struct {
+	message string
+	fields  []zap.Field
+}
+
+func (e *configError) Error() string {
+	return e.message
+}
+
+func newConfigError(message string, fields ...zap.Field) error {
+	return &configError{message: message, fields: fields}
+}
+
+// Log every problem found with the configuration, each one as an error of its own
+func logConfigErrors(err error) {
+	var problems []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		problems = joined.Unwrap()
+	} else {
+		problems = []error{err}
+	}
+	for _, problem := range problems {
+		if _, ok := problem.(interface{ Unwrap() []error }); ok {
+			logConfigErrors(problem)
+		} else if configErr, ok := problem.(*configError); ok {
+			logger.Error(configErr.message, configErr.fields...)
+		} else {
+			logger.Error("Invalid configuration", zap.Error(problem))
+		}
+	}
+}
+
+// Log every problem found with the configuration and exit, as there is nothing sensible to fall back to
+func exitOnConfigErrors(err error) {
+	if err == nil {
+		return
+	}
+	logConfigErrors(err)
+	logger.Fatal("Invalid configuration, please correct the problems reported")
+}
+
+// Validate the URLs and authentication settings of a TM1 v12 service instance, normalizing them where required
+func validateTM1Instance(instance *tm1Instance) error {
+	var errs []error
+
 	// Validate the databases URL
-	databasesResourceAndQuery := strings.Split(viper.GetString("tm1-v12.databases-url"), "?")
+	databasesResourceAndQuery := strings.Split(instance.DatabasesURL, "?")
 	protoAndResource := strings.SplitN(databasesResourceAndQuery[0], "://", 2)
 	if len(protoAndResource) != 2 || (protoAndResource[0] != "http" && protoAndResource[0] != "https") {
-		logger.Fatal("Invalid Databases url specified: protocol missing or invalid", zap.String("tm1-v12.databases-url", viper.GetString("tm1-v12.databases-url")))
-	}
-	hostAndPathSegments := strings.Split(protoAndResource[1], "/")
-	if len(hostAndPathSegments) < 2 || len(databasesResourceAndQuery) > 2 {
-		logger.Fatal("Invalid Databases url specified", zap.String("tm1-v12.databases-url", viper.GetString("tm1-v12.databases-url")))
-	}
-	if hostAndPathSegments[len(hostAndPathSegments)-1] != "Databases" {
-		logger.Fatal("Invalid Databases url specified: path should end with 'Databases' segment", zap.String("tm1-v12.databases-url", viper.GetString("tm1-v12.databases-url")))
+		errs = append(errs, newConfigError("Invalid Databases url specified: protocol missing or invalid", zap.String("instance", instance.Name), zap.String("databases-url", instance.DatabasesURL)))
+	} else if hostAndPathSegments := strings.Split(protoAndResource[1], "/"); len(hostAndPathSegments) < 2 || len(databasesResourceAndQuery) > 2 {
+		errs = append(errs, newConfigError("Invalid Databases url specified", zap.String("instance", instance.Name), zap.String("databases-url", instance.DatabasesURL)))
+	} else if hostAndPathSegments[len(hostAndPathSegments)-1] != "Databases" {
+		errs = append(errs, newConfigError("Invalid Databases url specified: path should end with 'Databases' segment", zap.String("instance", instance.Name), zap.String("databases-url", instance.DatabasesURL)))
 	}
 
 	// Validate the database URL template if one provided
-	databaseUrlTemplate := viper.GetString("tm1-v12.database-url-template")
+	databaseUrlTemplate := instance.DatabaseURLTemplate
 	if databaseUrlTemplate == "" {
 		databaseUrlTemplate = databasesResourceAndQuery[0] + "('{{.database}}')"
 		if len(databasesResourceAndQuery) == 2 {
 			databaseUrlTemplate = databaseUrlTemplate + "?" + databasesResourceAndQuery[1]
 		}
-		viper.Set("tm1-v12.database-url-template$", databaseUrlTemplate)
+		instance.DatabaseURLTemplate = databaseUrlTemplate
 	} else {
 		// Regular expression to match variables in a template
 		templateVarRegex := regexp.MustCompile(`{{([^\/]+)}}`)
@@ -143,19 +525,63 @@ func buildConfig() {
 
 		// Check it only contains one variable and that the variable is named 'database'
 		if len(matches) != 2 || matches[1] != "database" {
-			logger.Fatal("Database URL template invalid. Template should contain exactly one variable named 'database' as in 'Databases('{{database}}')", zap.String("tm1-v12.database-url-template", databaseUrlTemplate))
+			errs = append(errs, newConfigError("Database URL template invalid. Template should contain exactly one variable named 'database' as in 'Databases('{{database}}')", zap.String("instance", instance.Name), zap.String("database-url-template", databaseUrlTemplate)))
 		}
 
 		// Use the regex to replace {{database}} with {{.database}}
-		viper.Set("tm1-v12.database-url-template$", templateVarRegex.ReplaceAllString(databaseUrlTemplate, "{{.$1}}"))
+		instance.DatabaseURLTemplate = templateVarRegex.ReplaceAllString(databaseUrlTemplate, "{{.$1}}")
 	}
 
-	// Valid the port range specified
-	portMin := viper.GetInt("servers.port-range.min")
-	portMax := viper.GetInt("servers.port-range.max")
-	if portMin <= 0 || portMax > 65535 || portMin > portMax {
-		logger.Error("No valid port range specified! Falling back to using default port range [9601:9659]!", zap.Int("servers.port-range.min", portMin), zap.Int("servers.port-range.max", portMax))
-		viper.Set("servers.port-range.min", nil)
-		viper.Set("servers.port-range.max", nil)
+	// Validate the replica URL template if one provided
+	if replicaUrlTemplate := instance.ReplicaURLTemplate; replicaUrlTemplate != "" {
+		// Regular expression to match variables in a template
+		templateVarRegex := regexp.MustCompile(`{{([^{}]+)}}`)
+		matches := templateVarRegex.FindAllStringSubmatch(replicaUrlTemplate, -1)
+
+		// Check it only contains the variables named 'database' and 'replica', exactly once each
+		variables := []string{}
+		for _, match := range matches {
+			variables = append(variables, match[1])
+		}
+		slices.Sort(variables)
+		if !slices.Equal(variables, []string{"database", "replica"}) {
+			errs = append(errs, newConfigError("Replica URL template invalid. Template should contain exactly two variables named 'database' and 'replica' as in 'Databases('{{database}}')/Replicas('{{replica}}')'", zap.String("instance", instance.Name), zap.String("replica-url-template", replicaUrlTemplate)))
+		}
+
+		// Use the regex to replace {{database}} and {{replica}} with {{.database}} and {{.replica}}
+		instance.ReplicaURLTemplate = templateVarRegex.ReplaceAllString(replicaUrlTemplate, "{{.$1}}")
+	}
+	if instance.WriterRole == "" {
+		instance.WriterRole = "primary"
+	}
+
+	// Validate the rules deciding which databases are advertised, and under which name
+	if err := validateDatabaseFilters(instance); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Validate the OAuth2 settings if OAuth2 authentication is used
+	if tokenURL := instance.Auth.OAuth2.TokenURL; tokenURL != "" {
+		if u, err := url.Parse(tokenURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, newConfigError("Invalid OAuth2 token url specified: protocol missing or invalid", zap.String("instance", instance.Name), zap.String("token-url", tokenURL)))
+		}
+		if instance.Auth.OAuth2.ClientID == "" {
+			errs = append(errs, newConfigError("No OAuth2 client ID specified", zap.String("instance", instance.Name), zap.String("token-url", tokenURL)))
+		}
+		switch instance.Auth.OAuth2.ClientAuthMethod {
+		case "basic", "post":
+		case "":
+			instance.Auth.OAuth2.ClientAuthMethod = "basic"
+		default:
+			logger.Error("Unknown OAuth2 client authentication method, please specify basic or post, defaulting to basic", zap.String("instance", instance.Name), zap.String("client-auth-method", instance.Auth.OAuth2.ClientAuthMethod))
+			instance.Auth.OAuth2.ClientAuthMethod = "basic"
+		}
+		if refreshBefore, err := time.ParseDuration(instance.Auth.OAuth2.RefreshBefore); err != nil || refreshBefore < 0 {
+			if instance.Auth.OAuth2.RefreshBefore != "" {
+				logger.Error("No valid OAuth2 token refresh time specified! Falling back to refreshing tokens 60s before they expire!", zap.String("instance", instance.Name), zap.String("refresh-before", instance.Auth.OAuth2.RefreshBefore))
+			}
+			instance.Auth.OAuth2.RefreshBefore = "60s"
+		}
 	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Log the problems with the configuration and return the messages logged
+func loggedConfigErrors(t *testing.T, err error) []string {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	previous := logger
+	logger = zap.New(core)
+	t.Cleanup(func() { logger = previous })
+
+	logConfigErrors(err)
+	messages := []string{}
+	for _, entry := range logs.All() {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+func TestValidateDatabaseFiltersReportsEveryProblem(t *testing.T) {
+	instance := &tm1Instance{
+		Name:    "prod",
+		Include: []databaseFilter{{Name: "["}, {}},
+		Aliases: []databaseAlias{{Database: "Sales", Server: "Sales/EU"}, {Database: "Budget", Server: "Plan"}, {Database: "budget", Server: "Budget"}, {Database: "Forecast", Server: "plan"}},
+	}
+	err := validateDatabaseFilters(instance)
+	if err == nil {
+		t.Fatal("expected the filters and aliases to be invalid")
+	}
+	messages := loggedConfigErrors(t, err)
+	if len(messages) != 5 {
+		t.Fatalf("expected 5 problems to be reported, got %d: %v", len(messages), messages)
+	}
+
+	// Valid filters and aliases are no problem at all
+	instance = &tm1Instance{Name: "prod", Include: []databaseFilter{{Name: "Sales*"}}, Aliases: []databaseAlias{{Database: "Budget", Server: "Plan"}}}
+	if err := validateDatabaseFilters(instance); err != nil {
+		t.Errorf("expected the filters and aliases to be valid, got %v", err)
+	}
+}
+
+func TestBuildPortConfigReportsEveryProblem(t *testing.T) {
+	viper.Set("servers.excluded-ports", []int{9610})
+	viper.Set("servers.pinned-ports", []map[string]interface{}{
+		{"server": "Sales", "port": 9601},
+		{"server": "", "port": 9602},
+		{"server": "Budget", "port": 9610},
+		{"server": "Plan", "port": 9601},
+		{"server": "Sales", "port": 9603},
+	})
+	t.Cleanup(func() {
+		viper.Set("servers.excluded-ports", nil)
+		viper.Set("servers.pinned-ports", nil)
+	})
+
+	err := buildPortConfig()
+	if err == nil {
+		t.Fatal("expected the pinned ports to be invalid")
+	}
+	messages := loggedConfigErrors(t, err)
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 problems to be reported, got %d: %v", len(messages), messages)
+	}
+
+	// The valid pins are kept
+	pins, _ := viper.Get("servers.pinned-ports$").(map[string]int)
+	if len(pins) != 1 || pins["Sales"] != 9601 {
+		t.Errorf("expected only Sales to be pinned to 9601, got %v", pins)
+	}
+}
+
+func TestReloadConfigKeepsPreviousConfigurationOnProblems(t *testing.T) {
+	loggerLevel = zap.NewAtomicLevel()
+	t.Cleanup(viper.Reset)
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(config string) {
+		if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"servers": {"host-name": "", "changes": {"history": 50}}}`)
+	if err := initConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := buildConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		history int
+	}{
+		{"invalid setting", `{"servers": {"host-name": "", "changes": {"history": 75}, "client-auth": {"mode": "sometimes"}}}`, 50},
+		{"unreadable file", `{"servers": {`, 50},
+		{"valid file", `{"servers": {"host-name": "", "changes": {"history": 100}}}`, 100},
+	}
+	for _, test := range tests {
+		writeConfig(test.config)
+		reloadConfig()
+		if history := viper.GetInt("servers.changes.history"); history != test.history {
+			t.Errorf("%s: expected a change history of %d, got %d", test.name, test.history, history)
+		}
+		if mode := viper.GetString("servers.client-auth.mode"); mode != clientAuthNone {
+			t.Errorf("%s: expected the client authentication mode to remain none, got %s", test.name, mode)
+		}
+		if instances, _ := viper.Get("tm1-v12.instances$").([]tm1Instance); len(instances) != 1 {
+			t.Errorf("%s: expected the TM1 v12 instance to remain configured, got %v", test.name, instances)
+		}
+	}
+}
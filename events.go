@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Clients ask for the changes to the servers to be streamed as server-sent events using the Accept header
+func acceptsEventStream(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(mediaType, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "text/event-stream") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handler for requests for the stream of changes to the Servers entity set. Every server added or updated is sent as
+// a changed event and every server removed, or no longer matching the filter, as a removed event, both carrying the
+// same object as in a delta response. Servers that never matched the filter aren't sent at all. The ID of every event
+// is the delta token for the changes after it, so clients reconnecting using the Last-Event-ID header, or a
+// $deltatoken, continue where they left off.
+func serverEventsResource(w http.ResponseWriter, r *http.Request, query *serverQuery) {
+	if !query.tracksChanges() {
+		writeODataError(w, r, http.StatusBadRequest, errorCodeInvalidQuery, "Only the system query options '$filter' and '$select' can be used to stream changes")
+		return
+	}
+	controller := http.NewResponseController(w)
+
+	// Start from the last event the client received, if reconnecting, from the current servers otherwise
+	token := query.deltaToken
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		token = lastEventID
+	}
+	if token == "" {
+		token = currentServerChangeToken()
+	}
+	deltas, next, changed, err := serverChangesSince(token)
+	if err != nil {
+		writeODataError(w, r, http.StatusGone, errorCodeDeltaTokenExpired, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep reverse proxies in front of us from buffering the events
+	w.WriteHeader(http.StatusOK)
+	logger.Debug("Server events stream opened", zap.String("remote-addr", r.RemoteAddr), zap.String("token", token))
+
+	keepAlive := time.NewTicker(viper.GetDuration("servers.changes.keep-alive"))
+	defer keepAlive.Stop()
+	for {
+		// Send the changes, if any, a comment otherwise so the client knows the stream is alive
+		for _, delta := range deltas {
+			if !delta.concerns(query) {
+				continue
+			}
+			event := "changed"
+			if delta.server == nil || !query.matches(delta.server) {
+				event = "removed"
+			}
+			data, _ := json.Marshal(NewServerDeltaObject(delta, query))
+			if _, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", serverChangeToken(delta.seq), event, data); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			logger.Debug("Server events stream closed", zap.Error(err), zap.String("remote-addr", r.RemoteAddr))
+			return
+		}
+
+		// Wait for the next change, until the client goes away or we are shutting down
+		deltas = nil
+		select {
+		case <-changed:
+			deltas, next, changed, err = serverChangesSince(next)
+			if err != nil {
+				// We fell too far behind, let the client start over
+				fmt.Fprintf(w, "event: expired\ndata: %q\n\n", err.Error())
+				controller.Flush()
+				return
+			}
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			err = r.Context().Err()
+		case <-drainStarted:
+			err = errors.New("shutting down")
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// File locking is not supported on this platform, only a single process should use the port map file
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
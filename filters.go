@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Define a struct for a rule matching databases, every property specified needs to match. Patterns use the syntax
+// of path.Match, as in "Scratch*", and are matched case-insensitively.
+type databaseFilter struct {
+	Name           string `mapstructure:"name"`            // Pattern the name of the database needs to match
+	ProductVersion string `mapstructure:"product-version"` // Pattern the product version needs to match, as in "12.4.*"
+	ReplicaState   string `mapstructure:"replica-state"`   // Pattern the state of at least one of the active replicas needs to match
+}
+
+// Define a struct for a database advertised as a server by a name other than its own
+type databaseAlias struct {
+	Database string `mapstructure:"database"`
+	Server   string `mapstructure:"server"`
+}
+
+// Returns true if the pattern, if any, matches the value
+func matchesPattern(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return matched
+}
+
+// Returns true if the database matches the rule
+func (filter *databaseFilter) matches(database *Database) bool {
+	if !matchesPattern(filter.Name, database.Name) || !matchesPattern(filter.ProductVersion, database.ProductVersion.SemVer) {
+		return false
+	}
+	if filter.ReplicaState == "" {
+		return true
+	}
+	for _, replica := range database.ActiveReplicas {
+		if matchesPattern(filter.ReplicaState, replica.State) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the database gets advertised as a server, it needs replicas, match any of the include rules, if
+// there are any, and none of the exclude rules
+func (instance *tm1Instance) advertises(database *Database) bool {
+	if database.Replicas <= 0 {
+		return false
+	}
+	included := len(instance.Include) == 0
+	for i := range instance.Include {
+		if instance.Include[i].matches(database) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for i := range instance.Exclude {
+		if instance.Exclude[i].matches(database) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate the include and exclude rules and the aliases of an instance
+func validateDatabaseFilters(instance *tm1Instance) error {
+	var errs []error
+	for _, filters := range [][]databaseFilter{instance.Include, instance.Exclude} {
+		for _, filter := range filters {
+			for _, pattern := range []string{filter.Name, filter.ProductVersion, filter.ReplicaState} {
+				if _, err := path.Match(pattern, ""); err != nil {
+					errs = append(errs, newConfigError("Invalid database filter specified: pattern invalid", zap.String("instance", instance.Name), zap.String("pattern", pattern), zap.Error(err)))
+				}
+			}
+			if filter.Name == "" && filter.ProductVersion == "" && filter.ReplicaState == "" {
+				errs = append(errs, newConfigError("Invalid database filter specified: a rule requires a name, product-version or replica-state pattern", zap.String("instance", instance.Name)))
+			}
+		}
+	}
+
+	// Every database can have one alias, and no two databases can be advertised under the same alias
+	databases := map[string]bool{}
+	servers := map[string]string{}
+	for _, alias := range instance.Aliases {
+		if alias.Database == "" || alias.Server == "" || strings.ContainsAny(alias.Server, "/'") {
+			errs = append(errs, newConfigError("Invalid database alias specified: a database and a server name, which cannot contain a '/' or a quote, are required", zap.String("instance", instance.Name), zap.String("database", alias.Database), zap.String("server", alias.Server)))
+			continue
+		}
+		if databases[strings.ToLower(alias.Database)] {
+			errs = append(errs, newConfigError("Invalid database alias specified: database has an alias already", zap.String("instance", instance.Name), zap.String("database", alias.Database)))
+			continue
+		}
+		if other, exists := servers[strings.ToLower(alias.Server)]; exists {
+			errs = append(errs, newConfigError("Invalid database alias specified: alias is used for another database already", zap.String("instance", instance.Name), zap.String("server", alias.Server), zap.String("other-database", other)))
+			continue
+		}
+		databases[strings.ToLower(alias.Database)] = true
+		servers[strings.ToLower(alias.Server)] = alias.Database
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Define a struct for a key in a JSON web key set (RFC 7517)
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Alg     string `json:"alg"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	key     crypto.PublicKey
+}
+
+// JSON web key set, re-read whenever the file changed
+type jwksFile struct {
+	file    string
+	mu      sync.Mutex
+	modTime time.Time
+	keys    []jsonWebKey
+}
+
+// Decode a base64url encoded value, with or without padding
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// Parse the public key of a JSON web key, supporting RSA, EC (P-256, P-384 and P-521) and Ed25519 keys
+func (jwk *jsonWebKey) parse() error {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBase64URL(jwk.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeBase64URL(jwk.E)
+		if err != nil {
+			return err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return errors.New("RSA key '" + jwk.KeyID + "' is invalid or shorter than 2048 bits")
+		}
+		jwk.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return errors.New("curve '" + jwk.Curve + "' of EC key '" + jwk.KeyID + "' not supported")
+		}
+		x, err := decodeBase64URL(jwk.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeBase64URL(jwk.Y)
+		if err != nil {
+			return err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return errors.New("EC key '" + jwk.KeyID + "' is not on curve " + jwk.Curve)
+		}
+		jwk.key = key
+	case "OKP":
+		x, err := decodeBase64URL(jwk.X)
+		if err != nil {
+			return err
+		}
+		if jwk.Curve != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return errors.New("OKP key '" + jwk.KeyID + "' is not a valid Ed25519 key")
+		}
+		jwk.key = ed25519.PublicKey(x)
+	default:
+		return errors.New("type '" + jwk.KeyType + "' of key '" + jwk.KeyID + "' not supported")
+	}
+	return nil
+}
+
+// Re-read the key set if the file changed since we last read it. Callers need to hold ks.mu, or be the only one
+// holding a reference to it.
+func (ks *jwksFile) refresh() error {
+	info, err := os.Stat(ks.file)
+	if err != nil {
+		return err
+	}
+	if ks.keys != nil && info.ModTime().Equal(ks.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(ks.file)
+	if err != nil {
+		return err
+	}
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return err
+	}
+	keys := []jsonWebKey{}
+	for _, jwk := range keySet.Keys {
+		// Keys meant for encryption are of no use to us
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if err := jwk.parse(); err != nil {
+			logger.Warn("Unable to use key in JSON web key set, ignoring it", zap.Error(err), zap.String("jwks-file", ks.file))
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	if len(keys) == 0 {
+		return errors.New("no usable signing keys found in JSON web key set " + ks.file)
+	}
+	logger.Info("JSON web key set loaded", zap.String("jwks-file", ks.file), zap.Int("keys", len(keys)))
+	ks.modTime = info.ModTime()
+	ks.keys = keys
+	return nil
+}
+
+// Returns the keys that could have signed a token with the key ID and algorithm
+func (ks *jwksFile) candidateKeys(keyID string, alg string) []jsonWebKey {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	// Keep using the keys we have if the changed file can't be read, it is likely being written
+	if err := ks.refresh(); err != nil {
+		logger.Warn("Unable to refresh JSON web key set, continuing to use the current keys", zap.Error(err), zap.String("jwks-file", ks.file))
+	}
+	candidates := []jsonWebKey{}
+	for _, jwk := range ks.keys {
+		if (keyID == "" || jwk.KeyID == keyID) && (jwk.Alg == "" || jwk.Alg == alg) {
+			candidates = append(candidates, jwk)
+		}
+	}
+	return candidates
+}
+
+// Verify the signature of the signing input using the key and the algorithm
+func verifyTokenSignature(key crypto.PublicKey, alg string, input []byte, signature []byte) bool {
+	var hash crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	digest := func() []byte {
+		h := hash.New()
+		h.Write(input)
+		return h.Sum(nil)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256", "RS384", "RS512":
+			return rsa.VerifyPKCS1v15(key, hash, digest(), signature) == nil
+		case "PS256", "PS384", "PS512":
+			return rsa.VerifyPSS(key, hash, digest(), signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		// The signature is the concatenation of r and s, each as long as the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		expected := map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}[alg]
+		if expected != key.Curve.Params().Name || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest(), r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, input, signature)
+	}
+	return false
+}
+
+// Returns true if the audience claim, either a string or an array of strings, contains the audience
+func hasAudience(claim interface{}, audience string) bool {
+	switch value := claim.(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, v := range value {
+			if s, _ := v.(string); s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the highest role in the role claim, either a string or an array of strings, ignoring unknown roles
+func roleFromClaim(claim interface{}) (adminRole, bool) {
+	names := []string{}
+	switch value := claim.(type) {
+	case string:
+		names = strings.Fields(value)
+	case []interface{}:
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+	highest, found := adminRoleNone, false
+	for _, name := range names {
+		if role, valid := parseAdminRole(name); valid {
+			found = true
+			if role > highest {
+				highest = role
+			}
+		}
+	}
+	return highest, found
+}
+
+// Verify a JSON web token (RFC 7519) signed by one of the keys in the key set, returning the name and role of the user
+func (ks *jwksFile) verifyToken(token string) (string, adminRole, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", adminRoleNone, errInvalidCredentials
+	}
+	headerData, err := decodeBase64URL(parts[0])
+	if err != nil {
+		return "", adminRoleNone, errInvalidCredentials
+	}
+	var header struct {
+		Alg   string `json:"alg"`
+		KeyID string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return "", adminRoleNone, errInvalidCredentials
+	}
+	switch header.Alg {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA":
+	default:
+		return "", adminRoleNone, errors.New("token signed using unsupported algorithm '" + header.Alg + "'")
+	}
+
+	// The token needs to be signed by one of the keys in the key set
+	signature, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return "", adminRoleNone, errInvalidCredentials
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, jwk := range ks.candidateKeys(header.KeyID, header.Alg) {
+		if verifyTokenSignature(jwk.key, header.Alg, input, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", adminRoleNone, errors.New("token signature could not be verified")
+	}
+
+	// Only accept tokens that are valid right now and issued by and for whom we expect
+	payload, err := decodeBase64URL(parts[1])
+	if err != nil {
+		return "", adminRoleNone, errInvalidCredentials
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", adminRoleNone, errInvalidCredentials
+	}
+	now := time.Now()
+	leeway := viper.GetDuration("admsrv.auth.jwt.leeway")
+	exp, hasExp := claims["exp"].(float64)
+	if !hasExp || now.Add(-leeway).After(time.Unix(int64(exp), 0)) {
+		return "", adminRoleNone, errors.New("token expired or without expiry")
+	}
+	if nbf, hasNbf := claims["nbf"].(float64); hasNbf && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", adminRoleNone, errors.New("token not valid yet")
+	}
+	if issuer := viper.GetString("admsrv.auth.jwt.issuer"); issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != issuer {
+			return "", adminRoleNone, errors.New("token issued by unexpected issuer '" + iss + "'")
+		}
+	}
+	if audience := viper.GetString("admsrv.auth.jwt.audience"); audience != "" && !hasAudience(claims["aud"], audience) {
+		return "", adminRoleNone, errors.New("token not issued for audience '" + audience + "'")
+	}
+
+	// The role comes from the role claim, if the token has one, from the configured users otherwise
+	name, _ := claims[viper.GetString("admsrv.auth.jwt.name-claim")].(string)
+	if name == "" {
+		return "", adminRoleNone, errors.New("token without name claim '" + viper.GetString("admsrv.auth.jwt.name-claim") + "'")
+	}
+	if role, found := roleFromClaim(claims[viper.GetString("admsrv.auth.jwt.role-claim")]); found {
+		return name, role, nil
+	}
+	return name, adminUserRole(name), nil
+}
@@ -1,112 +1,112 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"syscall"
 
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"golang.org/x/sys/windows/svc"
 )
 
 var logger *zap.Logger
 var loggerLevel zap.AtomicLevel
 
-func runServer() {
+// Run the admin host until the context gets cancelled, then shut down gracefully
+func runServer(ctx context.Context) {
 	// Initialize servers port map and file watcher
 	initPortMap()
 
-	// TODO: Kick off the PA proxy if we want one
+	// Kick off the PA proxy, if enabled
 	startPAReverseProxy()
 
-	// Kick off the reverse proxies for our servers
-	go func() {
-		err := refreshServers()
-		if err != nil {
-			logger.Error("Unable to refresh servers list", zap.Error(err))
-		}
-	}()
+	// Start serving the servers that got registered manually
+	initRegisteredServers()
+
+	// Kick off polling the databases, which in turn starts the reverse proxies for our servers
+	startServersPoller()
+
+	// Start the metrics listener, if metrics are served on a port of their own
+	adminServers := []*http.Server{}
+	if metricsServer := startMetricsListener(); metricsServer != nil {
+		adminServers = append(adminServers, metricsServer)
+	}
 
 	// Create an instance of our own router for the admin server API
 	var router admsrvRouter
 
 	httpsPort := viper.GetInt("admsrv.https-port")
 	httpPort := viper.GetInt("admsrv.http-port")
+	if httpsPort == 0 && httpPort == 0 {
+		logger.Fatal("No HTTP nor HTTPS port specified. Admin service will not be listening to any incoming requests!")
+	}
 
 	// Start listening to request to our REST API on the specified http and/or https port(s)
-	if httpsPort != 0 && httpPort != 0 {
-		// Start the HTTPS server in a separate goroutine
+	handler := logRequestResponse(listenerAdmin, "", &router)
+	if httpsPort != 0 {
+		listener, err := adminListener(httpsPort)
+		if err != nil {
+			logger.Fatal("HTTPS server failed to start", zap.Error(err))
+		}
+		tlsConfig, err := newReloadingTLSConfig(viper.GetString("admsrv.cert-file"), viper.GetString("admsrv.key-file"))
+		if err != nil {
+			logger.Fatal("HTTPS server failed to start, unable to load certificate", zap.Error(err), zap.String("admsrv.cert-file", viper.GetString("admsrv.cert-file")), zap.String("admsrv.key-file", viper.GetString("admsrv.key-file")))
+		}
+		httpsServer := &http.Server{Addr: listener.Addr().String(), Handler: handler, TLSConfig: tlsConfig, BaseContext: serverBaseContext}
+		adminServers = append(adminServers, httpsServer)
 		go func() {
 			logger.Info("Starting HTTPS server", zap.Int("port", httpsPort))
-			if err := http.ListenAndServeTLS(":"+strconv.Itoa(httpsPort), viper.GetString("admsrv.cert-file"), viper.GetString("admsrv.key-file"), logRequestResponse(&router)); err != nil {
+			if err := httpsServer.ServeTLS(listener, "", ""); err != http.ErrServerClosed {
 				logger.Fatal("HTTPS server failed to start", zap.Error(err))
 			}
 		}()
-
-		// Start the HTTP server
-		logger.Info("Starting HTTP server", zap.Int("port", httpPort))
-		if err := http.ListenAndServe(":"+strconv.Itoa(httpPort), logRequestResponse(&router)); err != nil {
-			logger.Fatal("HTTP server failed to start", zap.Error(err))
-		}
-	} else if httpsPort != 0 {
-		// Start the HTTPS server
-		logger.Info("Starting HTTPS server", zap.Int("port", httpsPort))
-		if err := http.ListenAndServeTLS(":"+strconv.Itoa(httpsPort), viper.GetString("admsrv.cert-file"), viper.GetString("admsrv.key-file"), logRequestResponse(&router)); err != nil {
-			logger.Fatal("HTTPS server failed to start", zap.Error(err))
-		}
-	} else if httpPort != 0 {
-		// Start the HTTP server
-		logger.Info("Starting HTTP server", zap.Int("port", httpPort))
-		if err := http.ListenAndServe(":"+strconv.Itoa(httpPort), logRequestResponse(&router)); err != nil {
-			logger.Fatal("HTTP server failed to start", zap.Error(err))
-		}
-	} else {
-		logger.Fatal("No HTTP nor HTTPS port specified. Admin service will not be listening to any incoming requests!")
 	}
-}
-
-type tm1AdminHostService struct{}
-
-func (m *tm1AdminHostService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (svcSpecificEC bool, exitCode uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
-	changes <- svc.Status{State: svc.StartPending}
-	go runServer()
-	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
-loop:
-	for c := range r {
-		switch c.Cmd {
-		case svc.Interrogate:
-			changes <- c.CurrentStatus
-		case svc.Stop, svc.Shutdown:
-			break loop
+	if httpPort != 0 {
+		listener, err := adminListener(httpPort)
+		if err != nil {
+			logger.Fatal("HTTP server failed to start", zap.Error(err))
 		}
+		httpServer := &http.Server{Addr: listener.Addr().String(), Handler: handler, BaseContext: serverBaseContext}
+		adminServers = append(adminServers, httpServer)
+		go func() {
+			logger.Info("Starting HTTP server", zap.Int("port", httpPort))
+			if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+				logger.Fatal("HTTP server failed to start", zap.Error(err))
+			}
+		}()
 	}
-	changes <- svc.Status{State: svc.StopPending}
 
-	// Gracefully shutdown all reverse proxies for our active servers
-	shutdownAllServers()
+	// Let the service manager know we are up and running, from here on the listeners take over until we get stopped
+	notifyReady()
+	<-ctx.Done()
 
-	return
+	// Let the service manager know we are on our way out and shut down gracefully
+	notifyStopping()
+	drainAndShutdown(adminServers)
+	logger.Info("TM1 v12 admin service stopped")
 }
 
-func runWindowsService(name string) {
-	run := svc.Run
-	logger.Info("Starting " + name + " Windows service")
-	err := run(name, &tm1AdminHostService{})
-	if err != nil {
-		logger.Error("Service "+name+" failed to start", zap.Error(err))
-		return
+// Returns the listener for an admin port, either the one handed to us by the service manager or a new one
+func adminListener(port int) (net.Listener, error) {
+	if listener, exists := activatedListeners()[port]; exists {
+		logger.Info("Using socket passed by service manager", zap.Int("port", port))
+		return listener, nil
 	}
-	logger.Info("Service " + name + " stopped")
+	return net.Listen("tcp", ":"+strconv.Itoa(port))
 }
 
-func setupSignalHandling() {
+// Cancel the context on SIGINT or SIGTERM so we shut down gracefully, a second signal exits immediately
+func setupSignalHandling(cancel context.CancelFunc) {
 	// Create a channel to listen for termination signals
-	signals := make(chan os.Signal, 1)
+	signals := make(chan os.Signal, 2)
 
 	// Notify the channel on SIGINT and SIGTERM
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
@@ -119,21 +119,37 @@ func setupSignalHandling() {
 		if logger != nil {
 			logger.Info("Shutdown signal received, shutting down servers...")
 		}
+		cancel()
 
-		// Gracefully shutdown all reverse proxies for our active servers
-		shutdownAllServers()
-
-		// Exit
-		os.Exit(0)
+		// Don't keep anybody waiting who really wants us gone
+		<-signals
+		if logger != nil {
+			logger.Warn("Second shutdown signal received, exiting immediately")
+		}
+		os.Exit(1)
 	}()
 }
 
-func main() {
+// Serve the admin API and the servers, as a service or as a console application
+func serve(configFile string) {
 	// Install signal handler making sure all proxies shut down gracefully
-	setupSignalHandling()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setupSignalHandling(cancel)
+	setupPlatformSignalHandling()
+
+	// Determine if the service is begin started as a service, a Windows service or a systemd service on Linux
+	isService, errService := isPlatformService()
+	if isService {
+		prepareServiceEnvironment(configFile)
+	}
 
-	// Process the config file
-	errConfig := initConfig()
+	// Process the config file, creating it with default values if this is the first time running this service
+	errConfig := initConfig(configFile)
+	if _, ok := errConfig.(viper.ConfigFileNotFoundError); ok {
+		viper.SafeWriteConfig()
+	}
+	watchConfig()
 
 	// Open or create the log file
 	logFile := viper.GetString("log.file")
@@ -156,17 +172,15 @@ func main() {
 	// Configure a file write syncer
 	fileSyncerCore := zapcore.NewCore(fileEncoder, zapcore.AddSync(file), loggerLevel)
 
-	// Determine if the service is begin started as a Windows service
-	isWindowsService, err := svc.IsWindowsService()
-	if err != nil {
+	if errService != nil {
 		// Initialize logging...
 		logger = zap.New(fileSyncerCore)
 		defer logger.Sync()
-		logger.Fatal("Failed to determine if we are running in a windows service", zap.Error(err))
+		logger.Fatal("Failed to determine if we are running as a service", zap.Error(errService))
 
-	} else if isWindowsService {
+	} else if isService {
 		// Initialize logging...
-		logger = zap.New(fileSyncerCore)
+		logger = newServiceLogger(fileSyncerCore)
 		defer logger.Sync()
 
 		// Write any issues with the configuration to the log now that we have it set up
@@ -179,10 +193,10 @@ func main() {
 		}
 
 		// Build/validate the configuration now, here, now that the logger is initialized
-		buildConfig()
+		exitOnConfigErrors(buildConfig())
 
-		// Run as a windows service
-		runWindowsService(viper.GetString("admsrv.service-name"))
+		// Run as a service
+		runPlatformService(ctx, viper.GetString("admsrv.service-name"))
 
 	} else {
 		// Initialize logging...
@@ -212,10 +226,46 @@ func main() {
 		}
 
 		// Build/validate the configuration now, here, now that the logger is initialized
-		buildConfig()
+		exitOnConfigErrors(buildConfig())
 
 		// Run as a console application
 		logger.Info("Starting TM1 v12 admin service")
-		runServer()
+		runServer(ctx)
+	}
+}
+
+func main() {
+	// Parse the options preceding the command, the command defaults to serve so services need no arguments
+	var configFile string
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	flags.StringVar(&configFile, "config", "", "path of the config file (default ./config.json)")
+	flags.Usage = func() { printUsage(flags) }
+	flags.Parse(os.Args[1:])
+	command, args := "serve", flags.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	// Run the command
+	switch command {
+	case "serve":
+		parseCommandFlags(command, args, &configFile)
+		serve(configFile)
+	case "validate-config":
+		parseCommandFlags(command, args, &configFile)
+		os.Exit(validateConfigCommand(configFile))
+	case "list-databases":
+		parseCommandFlags(command, args, &configFile)
+		os.Exit(listDatabasesCommand(configFile))
+	case "ports":
+		os.Exit(portsCommand(args, &configFile))
+	case "service":
+		os.Exit(serviceCommand(args, &configFile))
+	case "help":
+		printUsage(flags)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command '"+command+"'")
+		printUsage(flags)
+		os.Exit(2)
 	}
 }
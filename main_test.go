@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// Most of the code logs, tests don't need to see any of it
+	logger = zap.NewNop()
+	os.Exit(m.Run())
+}
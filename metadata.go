@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Define the types making up our model of the CSDL, from which both the XML and JSON versions of $metadata are built
+type csdlEnumMember string
+
+type csdlPropertyValue struct {
+	Property string
+	Value    interface{}
+}
+
+type csdlRecord []csdlPropertyValue
+
+type csdlAnnotation struct {
+	Term  string
+	Value interface{}
+}
+
+type csdlProperty struct {
+	Name        string
+	Type        string
+	Nullable    bool
+	Annotations []csdlAnnotation
+}
+
+type csdlEntityType struct {
+	Name        string
+	Key         []string
+	Annotations []csdlAnnotation
+	Properties  []csdlProperty
+}
+
+type csdlEntitySet struct {
+	Name        string
+	EntityType  string
+	Annotations []csdlAnnotation
+}
+
+type csdlEntityContainer struct {
+	Name        string
+	Annotations []csdlAnnotation
+	EntitySets  []csdlEntitySet
+}
+
+type csdlReference struct {
+	URI       string
+	Namespace string
+	Alias     string
+}
+
+type csdlSchema struct {
+	Namespace   string
+	Alias       string
+	Annotations []csdlAnnotation
+	EntityTypes []csdlEntityType
+	Container   csdlEntityContainer
+}
+
+type csdlDocument struct {
+	References []csdlReference
+	Schema     csdlSchema
+}
+
+// Build the model of an entity type from a Go struct. Every exported field not excluded from JSON encoding becomes a
+// property. The edm struct tag, as in `edm:"Edm.DateTimeOffset,nullable"`, overrides the type and nullability.
+func newEntityType(name string, goType reflect.Type, key []string, description string, propertyDescriptions map[string]string) csdlEntityType {
+	entityType := csdlEntityType{
+		Name:        name,
+		Key:         key,
+		Annotations: []csdlAnnotation{{Term: "Core.Description", Value: description}},
+	}
+	for i := 0; i < goType.NumField(); i++ {
+		field := goType.Field(i)
+		if !field.IsExported() || field.Tag.Get("json") == "-" {
+			continue
+		}
+		property := csdlProperty{Name: field.Name}
+		switch field.Type {
+		case reflect.TypeOf(NullableString("")):
+			property.Type, property.Nullable = "Edm.String", true
+		case reflect.TypeOf(NullableInt(0)):
+			property.Type, property.Nullable = "Edm.Int32", true
+		default:
+			switch field.Type.Kind() {
+			case reflect.Bool:
+				property.Type = "Edm.Boolean"
+			case reflect.Int, reflect.Int32:
+				property.Type = "Edm.Int32"
+			case reflect.Int64:
+				property.Type = "Edm.Int64"
+			default:
+				property.Type = "Edm.String"
+			}
+		}
+		if tag, exists := field.Tag.Lookup("edm"); exists {
+			typeAndOptions := strings.Split(tag, ",")
+			if typeAndOptions[0] != "" {
+				property.Type = typeAndOptions[0]
+			}
+			for _, option := range typeAndOptions[1:] {
+				if option == "nullable" {
+					property.Nullable = true
+				}
+			}
+		}
+
+		// Properties that are part of the key are never nullable and are implicitly read only
+		isKey := false
+		for _, k := range key {
+			if k == field.Name {
+				isKey = true
+				property.Nullable = false
+			}
+		}
+		if description, exists := propertyDescriptions[field.Name]; exists {
+			property.Annotations = append(property.Annotations, csdlAnnotation{Term: "Core.Description", Value: description})
+		}
+		if !isKey {
+			property.Annotations = append(property.Annotations, csdlAnnotation{Term: "Core.Permissions", Value: csdlEnumMember("Core.Permission/Read")})
+		}
+		entityType.Properties = append(entityType.Properties, property)
+	}
+	return entityType
+}
+
+// The model of our API
+var apiModel = csdlDocument{
+	References: []csdlReference{
+		{URI: "https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Capabilities.V1", Namespace: "Org.OData.Capabilities.V1", Alias: "Capabilities"},
+		{URI: "https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Core.V1", Namespace: "Org.OData.Core.V1", Alias: "Core"},
+	},
+	Schema: csdlSchema{
+		Namespace: "ibm.tm1.api.v1",
+		Alias:     "tm1",
+		Annotations: []csdlAnnotation{
+			{Term: "Core.SchemaVersion", Value: "12.0.0"},
+		},
+		EntityTypes: []csdlEntityType{
+			newEntityType("Server", reflect.TypeOf(Server{}), []string{"Name"},
+				"A collection of properties of the running server. Available without authenticating. Servers can be added, updated and deleted manually by authenticated clients.",
+				map[string]string{
+					"Name":                         "The name of the server.",
+					"SelfRegistered":               "Indicates whether the server was self registered, as every TM1 v12 database is, or manually added.",
+					"Host":                         "The host name off the server on which the TM1 server runs.",
+					"IPAddress":                    "The IP address on which the server can be reached.",
+					"IPv6Address":                  "The IPv6 address on which the server can be reached.",
+					"PortNumber":                   "The port number of the TM1 server, which is used to distinguish between multiple servers running on the same computer (always null).",
+					"ClientMessagePortNumber":      "A secondary port used to accept client messages concerning the progress and ultimate cancellation of a lengthy operation without tying up thread reserves (always null).",
+					"HTTPPortNumber":               "The port number on which the TM1 server listens for incoming HTTP(S) requests.",
+					"IsLocal":                      "Indicates whether or not the server is a LOCAL server (always false).",
+					"UsingSSL":                     "Indicates whether or not the server is configured to use SSL for client connections.",
+					"SSLCertificateID":             "Specifies the name of the principal to whom the server's certificate is issued.",
+					"SSLCertificateAuthority":      "Specifies the name of the certificate authority that issues the certificate.",
+					"SSLCertificateRevocationList": "Specifies the list of certificates that have been revoked by the issue certificate authority.",
+					"ClientExportSSLSvrCert":       "Specifies whether the client should retrieve the certificate authority certificate, which was originally used to issue the TM1 server's certificate, from the Microsoft Windows certificate store.",
+					"ClientExportSSLSvrKeyID":      "Specifies the identity key used by the client to export the certificate authority certificate, which was originally used to issue the TM1 server's certificate, from the Microsoft Windows certificate store.",
+					"AcceptingClients":             "Indicates whether or not the server is currently accepting clients or not.",
+					"LastUpdated":                  "The date and time of the last time this server entry got updated.",
+				}),
+		},
+		Container: csdlEntityContainer{
+			Name: "API",
+			Annotations: []csdlAnnotation{
+				{Term: "Capabilities.AsynchronousRequestsSupported", Value: false},
+				{Term: "Capabilities.ConformanceLevel", Value: csdlEnumMember("Capabilities.ConformanceLevelType/Minimal")},
+				{Term: "Capabilities.SupportedFormats", Value: []string{"application/json"}},
+				{Term: "Capabilities.SupportedMetadataFormats", Value: []string{"application/json", "application/xml"}},
+				{Term: "Core.ConventionalIDs", Value: true},
+				{Term: "Core.DereferenceableIDs", Value: true},
+				{Term: "Core.Description", Value: "Top-level container for the EDM that defines the resources that comprise the API, including entity sets, singletons, actions, and functions. If an item is defined in the EDM but is not defined within the API entity container, it is bound to another resource defined within the model."},
+				{Term: "Core.ODataVersions", Value: "4.0"},
+			},
+			EntitySets: []csdlEntitySet{
+				{
+					Name:       "Servers",
+					EntityType: "tm1.Server",
+					Annotations: []csdlAnnotation{
+						{Term: "Capabilities.SelectSupport", Value: csdlRecord{
+							{Property: "Countable", Value: true},
+							{Property: "Filterable", Value: true},
+							{Property: "Sortable", Value: true},
+							{Property: "SkipSupported", Value: true},
+							{Property: "TopSupported", Value: true},
+						}},
+						{Term: "Capabilities.CountRestrictions", Value: csdlRecord{
+							{Property: "Countable", Value: true},
+						}},
+						{Term: "Capabilities.ChangeTracking", Value: csdlRecord{
+							{Property: "Supported", Value: true},
+						}},
+						{Term: "Capabilities.FilterFunctions", Value: []string{"contains", "startswith", "endswith"}},
+						{Term: "Capabilities.TopSupported", Value: true},
+						{Term: "Capabilities.SkipSupported", Value: true},
+					},
+				},
+			},
+		},
+	},
+}
+
+// Write the XML representation of an annotation value
+func writeXMLValue(b *strings.Builder, indent string, value interface{}) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			b.WriteString(indent + "<Bool>true</Bool>\n")
+		} else {
+			b.WriteString(indent + "<Bool>false</Bool>\n")
+		}
+	case string:
+		b.WriteString(indent + "<String>" + xmlEscape(v) + "</String>\n")
+	case csdlEnumMember:
+		b.WriteString(indent + "<EnumMember>" + xmlEscape(string(v)) + "</EnumMember>\n")
+	case []string:
+		b.WriteString(indent + "<Collection>\n")
+		for _, s := range v {
+			writeXMLValue(b, indent+"\t", s)
+		}
+		b.WriteString(indent + "</Collection>\n")
+	case csdlRecord:
+		b.WriteString(indent + "<Record>\n")
+		for _, pv := range v {
+			b.WriteString(indent + "\t<PropertyValue Property=\"" + xmlEscape(pv.Property) + "\">\n")
+			writeXMLValue(b, indent+"\t\t", pv.Value)
+			b.WriteString(indent + "\t</PropertyValue>\n")
+		}
+		b.WriteString(indent + "</Record>\n")
+	}
+}
+
+func writeXMLAnnotations(b *strings.Builder, indent string, annotations []csdlAnnotation) {
+	for _, annotation := range annotations {
+		b.WriteString(indent + "<Annotation Term=\"" + xmlEscape(annotation.Term) + "\">\n")
+		writeXMLValue(b, indent+"\t", annotation.Value)
+		b.WriteString(indent + "</Annotation>\n")
+	}
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Build the XML representation of the CSDL document
+func (doc *csdlDocument) xml() []byte {
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	b.WriteString("<edmx:Edmx Version=\"4.0\" xmlns:edmx=\"http://docs.oasis-open.org/odata/ns/edmx\">\n")
+	for _, reference := range doc.References {
+		b.WriteString("\t<edmx:Reference Uri=\"" + xmlEscape(reference.URI) + ".xml\">\n")
+		b.WriteString("\t\t<edmx:Include Namespace=\"" + xmlEscape(reference.Namespace) + "\" Alias=\"" + xmlEscape(reference.Alias) + "\"/>\n")
+		b.WriteString("\t</edmx:Reference>\n")
+	}
+	b.WriteString("\t<edmx:DataServices>\n")
+	schema := &doc.Schema
+	b.WriteString("\t\t<Schema Namespace=\"" + xmlEscape(schema.Namespace) + "\" Alias=\"" + xmlEscape(schema.Alias) + "\" xmlns=\"http://docs.oasis-open.org/odata/ns/edm\">\n")
+	writeXMLAnnotations(&b, "\t\t\t", schema.Annotations)
+	for _, entityType := range schema.EntityTypes {
+		b.WriteString("\t\t\t<EntityType Name=\"" + xmlEscape(entityType.Name) + "\">\n")
+		b.WriteString("\t\t\t\t<Key>\n")
+		for _, key := range entityType.Key {
+			b.WriteString("\t\t\t\t\t<PropertyRef Name=\"" + xmlEscape(key) + "\"/>\n")
+		}
+		b.WriteString("\t\t\t\t</Key>\n")
+		writeXMLAnnotations(&b, "\t\t\t\t", entityType.Annotations)
+		for _, property := range entityType.Properties {
+			b.WriteString("\t\t\t\t<Property Name=\"" + xmlEscape(property.Name) + "\" Type=\"" + xmlEscape(property.Type) + "\"")
+			if !property.Nullable {
+				b.WriteString(" Nullable=\"false\"")
+			}
+			b.WriteString(">\n")
+			writeXMLAnnotations(&b, "\t\t\t\t\t", property.Annotations)
+			b.WriteString("\t\t\t\t</Property>\n")
+		}
+		b.WriteString("\t\t\t</EntityType>\n")
+	}
+	container := &schema.Container
+	b.WriteString("\t\t\t<EntityContainer Name=\"" + xmlEscape(container.Name) + "\">\n")
+	writeXMLAnnotations(&b, "\t\t\t\t", container.Annotations)
+	for _, entitySet := range container.EntitySets {
+		b.WriteString("\t\t\t\t<EntitySet Name=\"" + xmlEscape(entitySet.Name) + "\" EntityType=\"" + xmlEscape(entitySet.EntityType) + "\">\n")
+		writeXMLAnnotations(&b, "\t\t\t\t\t", entitySet.Annotations)
+		b.WriteString("\t\t\t\t</EntitySet>\n")
+	}
+	b.WriteString("\t\t\t</EntityContainer>\n")
+	b.WriteString("\t\t</Schema>\n")
+	b.WriteString("\t</edmx:DataServices>\n")
+	b.WriteString("</edmx:Edmx>\n")
+	return []byte(b.String())
+}
+
+// Returns the JSON representation of an annotation value
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case csdlEnumMember:
+		// Enumeration members are represented by the name of the member only
+		member := string(v)
+		if i := strings.LastIndex(member, "/"); i >= 0 {
+			member = member[i+1:]
+		}
+		return member
+	case csdlRecord:
+		record := odataObject{}
+		for _, pv := range v {
+			record = append(record, odataProperty{Name: pv.Property, Value: jsonValue(pv.Value)})
+		}
+		return record
+	default:
+		return v
+	}
+}
+
+func appendJSONAnnotations(object odataObject, annotations []csdlAnnotation) odataObject {
+	for _, annotation := range annotations {
+		object = append(object, odataProperty{Name: "@" + annotation.Term, Value: jsonValue(annotation.Value)})
+	}
+	return object
+}
+
+// Build the JSON representation of the CSDL document
+func (doc *csdlDocument) json() []byte {
+	schema := &doc.Schema
+	container := &schema.Container
+
+	references := odataObject{}
+	for _, reference := range doc.References {
+		references = append(references, odataProperty{Name: reference.URI + ".json", Value: odataObject{
+			{Name: "$Include", Value: []odataObject{{
+				{Name: "$Alias", Value: reference.Alias},
+				{Name: "$Namespace", Value: reference.Namespace},
+			}}},
+		}})
+	}
+
+	schemaObject := odataObject{{Name: "$Alias", Value: schema.Alias}}
+	schemaObject = appendJSONAnnotations(schemaObject, schema.Annotations)
+	for _, entityType := range schema.EntityTypes {
+		typeObject := odataObject{
+			{Name: "$Kind", Value: "EntityType"},
+			{Name: "$Key", Value: entityType.Key},
+		}
+		typeObject = appendJSONAnnotations(typeObject, entityType.Annotations)
+		for _, property := range entityType.Properties {
+			// Edm.String is the default type, non-nullable the default nullability
+			propertyObject := odataObject{}
+			if property.Type != "Edm.String" {
+				propertyObject = append(propertyObject, odataProperty{Name: "$Type", Value: property.Type})
+			}
+			if property.Nullable {
+				propertyObject = append(propertyObject, odataProperty{Name: "$Nullable", Value: true})
+			}
+			propertyObject = appendJSONAnnotations(propertyObject, property.Annotations)
+			typeObject = append(typeObject, odataProperty{Name: property.Name, Value: propertyObject})
+		}
+		schemaObject = append(schemaObject, odataProperty{Name: entityType.Name, Value: typeObject})
+	}
+	containerObject := odataObject{{Name: "$Kind", Value: "EntityContainer"}}
+	containerObject = appendJSONAnnotations(containerObject, container.Annotations)
+	for _, entitySet := range container.EntitySets {
+		entitySetObject := odataObject{
+			{Name: "$Type", Value: entitySet.EntityType},
+			{Name: "$Collection", Value: true},
+		}
+		entitySetObject = appendJSONAnnotations(entitySetObject, entitySet.Annotations)
+		containerObject = append(containerObject, odataProperty{Name: entitySet.Name, Value: entitySetObject})
+	}
+	schemaObject = append(schemaObject, odataProperty{Name: container.Name, Value: containerObject})
+
+	document := odataObject{
+		{Name: "$Version", Value: "4.0"},
+		{Name: "$EntityContainer", Value: schema.Namespace + "." + container.Name},
+		{Name: "$Reference", Value: references},
+		{Name: schema.Namespace, Value: schemaObject},
+	}
+	data, _ := json.MarshalIndent(document, "", "\t")
+	return data
+}
+
+// Build the service document, listing the entity sets in the entity container
+func (doc *csdlDocument) serviceDocument() []byte {
+	entitySets := []odataObject{}
+	for _, entitySet := range doc.Schema.Container.EntitySets {
+		entitySets = append(entitySets, odataObject{
+			{Name: "name", Value: entitySet.Name},
+			{Name: "kind", Value: "EntitySet"},
+			{Name: "url", Value: entitySet.Name},
+		})
+	}
+	data, _ := json.MarshalIndent(odataObject{
+		{Name: "@odata.context", Value: "$metadata"},
+		{Name: "value", Value: entitySets},
+	}, "", "\t")
+	return data
+}
+
+// The documents are built once, the first time they are requested
+var (
+	metadataOnce        sync.Once
+	metadataXML         []byte
+	metadataJSON        []byte
+	serviceDocumentJSON []byte
+)
+
+func buildMetadataDocuments() {
+	metadataOnce.Do(func() {
+		metadataXML = apiModel.xml()
+		metadataJSON = apiModel.json()
+		serviceDocumentJSON = apiModel.serviceDocument()
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Names of the listeners as used in the listener label of the request metrics
+const (
+	listenerAdmin   = "admin"
+	listenerServer  = "server"
+	listenerPAProxy = "pa-proxy"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests handled, by listener, server, method and status code.",
+	}, []string{"listener", "server", "method", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests, by listener and server.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"listener", "server"})
+
+	responseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "http_response_size_bytes",
+		Help:      "Size of HTTP response bodies, by listener and server.",
+		Buckets:   prometheus.ExponentialBuckets(100, 10, 7),
+	}, []string{"listener", "server"})
+
+	requestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests currently being handled, by listener.",
+	}, []string{"listener"})
+
+	upstreamErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "upstream_errors_total",
+		Help:      "Number of requests that could not be forwarded to the upstream, by listener and server.",
+	}, []string{"listener", "server"})
+
+	certificateExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Time at which the certificate served by our listeners expires, by certificate file.",
+	}, []string{"cert_file"})
+
+	listDatabasesLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "list_databases_last_success_timestamp_seconds",
+		Help:      "Time of the last successful request for the databases of a TM1 v12 service instance.",
+	}, []string{"instance"})
+
+	listDatabasesDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "list_databases_duration_seconds",
+		Help:      "Duration of the last request for the databases of a TM1 v12 service instance.",
+	}, []string{"instance"})
+
+	listDatabasesErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "list_databases_errors_total",
+		Help:      "Number of failed requests for the databases of a TM1 v12 service instance.",
+	}, []string{"instance"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "active_servers",
+		Help:      "Number of servers currently advertised.",
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return float64(len(activeServersByName))
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "assigned_ports",
+		Help:      "Number of ports assigned to servers in the port map.",
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return float64(len(portMapEntries))
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "tm1_admsrv",
+		Name:      "free_ports",
+		Help:      "Number of ports in the port range not used by any active server.",
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		free := 0
+		for _, port := range assignablePorts() {
+			if _, used := activeServersByPort[port]; !used {
+				free++
+			}
+		}
+		return float64(free)
+	})
+)
+
+// Returns the method of a request as used in the metrics, methods we don't expect are counted as other so clients
+// can't blow up the number of series by making up their own
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// Record the metrics of a request once it has been handled
+func observeRequest(listener string, server string, r *http.Request, statusCode int, size int64, duration time.Duration) {
+	requestsTotal.WithLabelValues(listener, server, methodLabel(r.Method), strconv.Itoa(statusCode)).Inc()
+	requestDuration.WithLabelValues(listener, server).Observe(duration.Seconds())
+	responseSize.WithLabelValues(listener, server).Observe(float64(size))
+}
+
+// Record the outcome of a request for the databases of a TM1 v12 service instance
+func observeListDatabases(instance string, err error, duration time.Duration) {
+	listDatabasesDuration.WithLabelValues(instance).Set(duration.Seconds())
+	if err != nil {
+		listDatabasesErrorsTotal.WithLabelValues(instance).Inc()
+	} else {
+		listDatabasesLastSuccess.WithLabelValues(instance).SetToCurrentTime()
+	}
+}
+
+// Forget the metrics of a server that is no longer advertised
+func forgetServerMetrics(server string) {
+	labels := prometheus.Labels{"listener": listenerServer, "server": server}
+	requestsTotal.DeletePartialMatch(labels)
+	requestDuration.DeletePartialMatch(labels)
+	responseSize.DeletePartialMatch(labels)
+	upstreamErrorsTotal.DeletePartialMatch(labels)
+}
+
+// Returns true if the metrics endpoint is served by the admin listener
+func isMetricsOnAdminListener() bool {
+	return viper.GetBool("metrics.enabled") && viper.GetInt("metrics.port") == 0
+}
+
+// Start listening for requests for metrics on their own port, if configured to do so, returning the server
+func startMetricsListener() *http.Server {
+	port := viper.GetInt("metrics.port")
+	if !viper.GetBool("metrics.enabled") || port == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(viper.GetString("metrics.path"), promhttp.Handler())
+	server := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux, BaseContext: serverBaseContext}
+	go func() {
+		logger.Info("Starting metrics server", zap.Int("port", port), zap.String("path", viper.GetString("metrics.path")))
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logger.Error("Metrics server failed to start", zap.Error(err), zap.Int("port", port))
+		}
+	}()
+	return server
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"net/http"
 )
 
 // Define a custom types for nullable Edm types
@@ -23,3 +26,148 @@ func (ni NullableInt) MarshalJSON() ([]byte, error) {
 	}
 	return json.Marshal(int(ni))
 }
+
+// Define an ordered JSON object, allowing properties to be returned in the order they are defined in
+type odataProperty struct {
+	Name  string
+	Value interface{}
+}
+
+type odataObject []odataProperty
+
+// Define MarshalJSON function to encode the properties in order
+func (o odataObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, property := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(property.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(property.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Stable error codes returned in OData error responses, clients can rely on these not changing
+const (
+	errorCodeInvalidQuery        = "InvalidQuery"
+	errorCodeInvalidRequestBody  = "InvalidRequestBody"
+	errorCodeUnsupportedFormat   = "UnsupportedFormat"
+	errorCodeNotImplemented      = "NotImplemented"
+	errorCodeMethodNotAllowed    = "MethodNotAllowed"
+	errorCodeResourceNotFound    = "ResourceNotFound"
+	errorCodeServerNotFound      = "ServerNotFound"
+	errorCodeServerExists        = "ServerExists"
+	errorCodeServerNotRegistered = "ServerNotRegistered"
+	errorCodeNoPortAvailable     = "NoPortAvailable"
+	errorCodeUnauthorized        = "Unauthorized"
+	errorCodeForbidden           = "Forbidden"
+	errorCodeUpstreamError       = "UpstreamError"
+	errorCodeUpstreamUnavailable = "UpstreamUnavailable"
+	errorCodeShuttingDown        = "ShuttingDown"
+	errorCodeDeltaTokenExpired   = "DeltaTokenExpired"
+)
+
+// Define the structure of an OData error response
+type ODataError struct {
+	Code       string           `json:"code"`
+	Message    string           `json:"message"`
+	InnerError *ODataInnerError `json:"innererror,omitempty"`
+}
+
+// The inner error carries the request ID, to correlate the error with the log, and, if the error was returned
+// by TM1, the status, code and message returned by TM1
+type ODataInnerError struct {
+	RequestID       string `json:"requestId,omitempty"`
+	UpstreamStatus  int    `json:"upstreamStatus,omitempty"`
+	UpstreamCode    string `json:"upstreamCode,omitempty"`
+	UpstreamMessage string `json:"upstreamMessage,omitempty"`
+}
+
+type ODataErrorResponse struct {
+	Error ODataError `json:"error"`
+}
+
+// Define an error type for errors returned by a TM1 v12 service, so they can be passed through to the client
+type upstreamError struct {
+	statusCode int
+	status     string
+	code       string
+	message    string
+}
+
+func (e *upstreamError) Error() string {
+	if e.message != "" {
+		return "upstream request failed with status " + e.status + ": " + e.message
+	}
+	return "upstream request failed with status " + e.status
+}
+
+// Create an upstream error from a response with an unexpected status, picking up the OData error if TM1 returned one
+func newUpstreamError(resp *http.Response, body []byte) *upstreamError {
+	err := &upstreamError{statusCode: resp.StatusCode, status: resp.Status}
+	var errorResponse ODataErrorResponse
+	if json.Unmarshal(body, &errorResponse) == nil {
+		err.code = errorResponse.Error.Code
+		err.message = errorResponse.Error.Message
+	}
+	return err
+}
+
+// Write an OData error response with the specified status code
+func writeODataError(w http.ResponseWriter, r *http.Request, statusCode int, code string, message string) {
+	writeODataErrorResponse(w, statusCode, ODataError{Code: code, Message: message, InnerError: &ODataInnerError{RequestID: requestID(r)}})
+}
+
+// Write an OData error response for an error returned by a TM1 v12 service. Client errors are passed through with
+// the status TM1 returned them with, anything else is reported as a bad gateway.
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	var upstreamErr *upstreamError
+	if !errors.As(err, &upstreamErr) {
+		writeODataError(w, r, http.StatusBadGateway, errorCodeUpstreamUnavailable, err.Error())
+		return
+	}
+	statusCode := upstreamErr.statusCode
+	if statusCode < 400 || statusCode >= 500 {
+		statusCode = http.StatusBadGateway
+	}
+	writeODataErrorResponse(w, statusCode, ODataError{
+		Code:    errorCodeUpstreamError,
+		Message: upstreamErr.Error(),
+		InnerError: &ODataInnerError{
+			RequestID:       requestID(r),
+			UpstreamStatus:  upstreamErr.statusCode,
+			UpstreamCode:    upstreamErr.code,
+			UpstreamMessage: upstreamErr.message,
+		},
+	})
+}
+
+// Write a method not allowed error response, listing the methods that are allowed
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	writeODataError(w, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, "The method '"+r.Method+"' is not allowed on this resource")
+}
+
+// Write a not found error response for a path that doesn't address any resource
+func writeResourceNotFound(w http.ResponseWriter, r *http.Request) {
+	writeODataError(w, r, http.StatusNotFound, errorCodeResourceNotFound, "No resource found for path '"+r.URL.Path+"'")
+}
+
+func writeODataErrorResponse(w http.ResponseWriter, statusCode int, odataError ODataError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ODataErrorResponse{Error: odataError})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Define a struct for a route of the PA proxy, forwarding requests with a path starting with the prefix to the target
+type paProxyRoute struct {
+	PathPrefix  string `mapstructure:"path-prefix"`
+	TargetURL   string `mapstructure:"target-url"`
+	StripPrefix bool   `mapstructure:"strip-prefix"`
+}
+
+// Define a struct for the PA proxy configuration so we can tell if it changed on a configuration reload
+type paProxyConfig struct {
+	Enabled   bool
+	TargetURL string
+	Port      int
+	UsingSSL  bool
+	CertFile  string
+	KeyFile   string
+	Routes    []paProxyRoute
+}
+
+var (
+	paProxyMu      sync.Mutex
+	paProxyServer  *http.Server
+	paProxyCurrent paProxyConfig
+	paProxyStarted bool = false
+)
+
+func loadPAProxyConfig() (paProxyConfig, error) {
+	config := paProxyConfig{
+		Enabled:   viper.GetBool("pa-proxy.enabled"),
+		TargetURL: viper.GetString("pa-proxy.target-url"),
+		Port:      viper.GetInt("pa-proxy.port"),
+		UsingSSL:  viper.GetBool("pa-proxy.using-ssl"),
+		CertFile:  viper.GetString("pa-proxy.cert-file"),
+		KeyFile:   viper.GetString("pa-proxy.key-file"),
+	}
+	if err := viper.UnmarshalKey("pa-proxy.routes", &config.Routes); err != nil {
+		return config, err
+	}
+	if !config.Enabled {
+		return config, nil
+	}
+
+	// Validate the configuration
+	if config.Port <= 0 || config.Port > 65535 {
+		return config, errors.New("invalid port specified for the PA proxy")
+	}
+	if config.TargetURL == "" && len(config.Routes) == 0 {
+		return config, errors.New("neither a target URL nor any routes specified for the PA proxy")
+	}
+	for _, route := range config.Routes {
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return config, errors.New("invalid path prefix '" + route.PathPrefix + "' specified for PA proxy route, path prefix should start with a '/'")
+		}
+		if route.TargetURL == "" {
+			return config, errors.New("no target URL specified for PA proxy route '" + route.PathPrefix + "'")
+		}
+	}
+	return config, nil
+}
+
+// Create a reverse proxy forwarding to the target URL, optionally stripping the path prefix first
+func newPAReverseProxy(target string, stripPrefix string) (*httputil.ReverseProxy, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if targetURL.Scheme != "http" && targetURL.Scheme != "https" {
+		return nil, errors.New("invalid target URL '" + target + "', protocol missing or invalid")
+	}
+
+	// Create a new reverse proxy targeting the targetURL
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	if stripPrefix != "" {
+		originalDirector := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, stripPrefix), "/")
+			req.URL.RawPath = ""
+			originalDirector(req)
+		}
+	}
+
+	// Define a custom error handler to log requests targeting the API that weren't handled
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		upstreamErrorsTotal.WithLabelValues(listenerPAProxy, "").Inc()
+		logger.Error("Error processing PA endpoint", zap.String("path", r.URL.Path), zap.String("target-url", target), zap.String("request-id", requestID(r)), zap.Error(err))
+		writeODataError(w, r, http.StatusBadGateway, errorCodeUpstreamUnavailable, "Unable to forward the request to '"+target+"'")
+	}
+	return proxy, nil
+}
+
+// Define a router dispatching requests to the proxy of the route with the longest matching path prefix
+type paProxyRouter struct {
+	prefixes []string
+	proxies  map[string]http.Handler
+	fallback http.Handler
+}
+
+func newPAProxyRouter(config paProxyConfig) (*paProxyRouter, error) {
+	router := &paProxyRouter{proxies: map[string]http.Handler{}}
+	for _, route := range config.Routes {
+		stripPrefix := ""
+		if route.StripPrefix {
+			stripPrefix = route.PathPrefix
+		}
+		proxy, err := newPAReverseProxy(route.TargetURL, stripPrefix)
+		if err != nil {
+			return nil, err
+		}
+		router.prefixes = append(router.prefixes, route.PathPrefix)
+		router.proxies[route.PathPrefix] = proxy
+	}
+	sort.Slice(router.prefixes, func(i, j int) bool {
+		return len(router.prefixes[i]) > len(router.prefixes[j])
+	})
+	if config.TargetURL != "" {
+		proxy, err := newPAReverseProxy(config.TargetURL, "")
+		if err != nil {
+			return nil, err
+		}
+		router.fallback = proxy
+	}
+	return router, nil
+}
+
+// Returns true if the path starts with the path prefix on a segment boundary, so /pa matches /pa and /pa/ui but not /pax
+func hasPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func (pr *paProxyRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range pr.prefixes {
+		if hasPathPrefix(r.URL.Path, prefix) {
+			pr.proxies[prefix].ServeHTTP(w, r)
+			return
+		}
+	}
+	if pr.fallback != nil {
+		pr.fallback.ServeHTTP(w, r)
+		return
+	}
+	writeResourceNotFound(w, r)
+}
+
+// Start the PA proxy, if enabled, based on the current configuration. Callers need to hold paProxyMu.
+func startPAReverseProxyLocked() {
+	paProxyStarted = true
+	config, err := loadPAProxyConfig()
+	paProxyCurrent = config
+	if err != nil {
+		logger.Error("Unable to start PA proxy, invalid configuration", zap.Error(err))
+		return
+	}
+	if !config.Enabled {
+		logger.Debug("PA proxy not enabled")
+		return
+	}
+
+	router, err := newPAProxyRouter(config)
+	if err != nil {
+		logger.Error("Unable to start PA proxy, invalid URL", zap.Error(err))
+		return
+	}
+
+	// Serve the certificate through the reloader so renewed certificates get picked up without restarting the proxy
+	tlsConfig := &tls.Config{}
+	if config.UsingSSL {
+		tlsConfig, err = newReloadingTLSConfig(config.CertFile, config.KeyFile)
+		if err != nil {
+			logger.Error("Unable to start PA proxy, using SSL, certificate invalid", zap.Error(err), zap.String("pa-proxy.cert-file", config.CertFile), zap.String("pa-proxy.key-file", config.KeyFile))
+			return
+		}
+	}
+
+	// Now that we have initiated the reverse proxy handlers, start listening to the port associated to the PA proxy
+	httpServer := &http.Server{
+		Addr:        ":" + strconv.Itoa(config.Port),
+		Handler:     logRequestResponse(listenerPAProxy, "", router),
+		TLSConfig:   tlsConfig,
+		BaseContext: serverBaseContext,
+	}
+	paProxyServer = httpServer
+
+	logger.Info("Starting PA proxy", zap.Int("port", config.Port), zap.String("redirect-url", config.TargetURL), zap.Int("routes", len(config.Routes)), zap.Bool("using-ssl", config.UsingSSL))
+
+	go func() {
+		// Using SSL?
+		if config.UsingSSL {
+			if err := httpServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				logger.Error("PA proxy, using SSL, failed to start", zap.Error(err), zap.Int("port", config.Port))
+			}
+		} else {
+			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Error("PA proxy failed to start", zap.Error(err), zap.Int("port", config.Port))
+			}
+		}
+	}()
+}
+
+// Stop the PA proxy if it is running, forcibly once the context expires. Callers need to hold paProxyMu.
+func stopPAReverseProxyLocked(ctx context.Context) {
+	if paProxyServer == nil {
+		return
+	}
+	logger.Info("Terminating PA proxy", zap.Int("port", paProxyCurrent.Port))
+	if err := shutdownHTTPServer(ctx, paProxyServer); err != nil {
+		logger.Error("Error shutting down PA proxy", zap.Error(err), zap.Int("port", paProxyCurrent.Port))
+	}
+	paProxyServer = nil
+}
+
+func startPAReverseProxy() {
+	paProxyMu.Lock()
+	defer paProxyMu.Unlock()
+	startPAReverseProxyLocked()
+}
+
+func stopPAReverseProxy(ctx context.Context) {
+	paProxyMu.Lock()
+	defer paProxyMu.Unlock()
+	stopPAReverseProxyLocked(ctx)
+	paProxyStarted = false
+}
+
+// Restart the PA proxy if its configuration changed, called whenever the configuration got reloaded
+func reloadPAReverseProxy() {
+	paProxyMu.Lock()
+	defer paProxyMu.Unlock()
+
+	// Nothing to do if the PA proxy hasn't been started (yet) or is stopped
+	if !paProxyStarted {
+		return
+	}
+	config, _ := loadPAProxyConfig()
+	if reflect.DeepEqual(config, paProxyCurrent) {
+		return
+	}
+	logger.Info("PA proxy configuration changed, restarting PA proxy")
+	ctx, cancel := newServerShutdownContext()
+	defer cancel()
+	stopPAReverseProxyLocked(ctx)
+	startPAReverseProxyLocked()
+}
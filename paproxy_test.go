@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path     string
+		prefix   string
+		expected bool
+	}{
+		{"/pa", "/pa", true},
+		{"/pa/", "/pa", true},
+		{"/pa/ui/index.html", "/pa", true},
+		{"/pax", "/pa", false},
+		{"/pa-admin/ui", "/pa", false},
+		{"/pa/ui", "/pa/", true},
+		{"/pa", "/pa/", false},
+		{"/anything", "/", true},
+		{"/", "/", true},
+	}
+	for _, test := range tests {
+		if actual := hasPathPrefix(test.path, test.prefix); actual != test.expected {
+			t.Errorf("hasPathPrefix(%q, %q): expected %t, got %t", test.path, test.prefix, test.expected, actual)
+		}
+	}
+}
+
+func TestPAProxyRouterMatchesOnSegmentBoundary(t *testing.T) {
+	var served string
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = name })
+	}
+	router := &paProxyRouter{
+		prefixes: []string{"/pa/admin", "/pa"},
+		proxies:  map[string]http.Handler{"/pa/admin": handler("admin"), "/pa": handler("pa")},
+		fallback: handler("fallback"),
+	}
+	tests := map[string]string{
+		"/pa":             "pa",
+		"/pa/ui":          "pa",
+		"/pa/admin/users": "admin",
+		"/pa/administer":  "pa",
+		"/pax":            "fallback",
+	}
+	for path, expected := range tests {
+		served = ""
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://pa"+path, nil))
+		if served != expected {
+			t.Errorf("%s: expected to be served by %s, got %q", path, expected, served)
+		}
+	}
+}
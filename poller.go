@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Define a struct representing a refresh of the servers that is in progress, allowing others to wait for it
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	refreshMu                  sync.Mutex
+	refreshInFlight            *refreshCall
+	lastRefreshSuccess         time.Time
+	serversListedSince         = time.Now() // The servers list starts out empty, until the first refresh succeeds
+	consecutiveRefreshFailures int
+
+	pollerStop chan struct{}
+	pollerDone chan struct{}
+)
+
+// Refresh the servers, coalescing concurrent callers into a single request to the TM1 v12 service
+func refreshServersShared() error {
+	refreshMu.Lock()
+	if call := refreshInFlight; call != nil {
+		// A refresh is already in progress, wait for it and share its outcome
+		refreshMu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	refreshInFlight = call
+	refreshMu.Unlock()
+
+	call.err = refreshServers()
+
+	refreshMu.Lock()
+	refreshInFlight = nil
+	if call.err == nil {
+		lastRefreshSuccess = time.Now()
+		consecutiveRefreshFailures = 0
+	} else {
+		consecutiveRefreshFailures++
+	}
+	refreshMu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// Returns the time of the last successful refresh of the servers, zero if there hasn't been one yet
+func serversLastRefreshed() time.Time {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	return lastRefreshSuccess
+}
+
+// Make sure the servers are refreshed if forced to. Until the poller refreshed them successfully for the first time,
+// the servers list is empty, which is answered as is, rather than blocking every request on the TM1 v12 service.
+func ensureServersRefreshed(force bool) {
+	if force {
+		if err := refreshServersShared(); err != nil {
+			logger.Error("Unable to refresh servers list", zap.Error(err))
+		}
+	}
+}
+
+// Determine how long to wait before polling again, backing off exponentially after failures
+func nextPollDelay() time.Duration {
+	refreshMu.Lock()
+	failures := consecutiveRefreshFailures
+	refreshMu.Unlock()
+
+	interval := viper.GetDuration("tm1-v12.poll.interval")
+	delay := interval
+	if failures > 0 {
+		maxBackoff := viper.GetDuration("tm1-v12.poll.max-backoff")
+		for i := 0; i < failures && delay < maxBackoff; i++ {
+			delay *= 2
+		}
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+
+	// Add some jitter so multiple admin hosts don't end up polling in lockstep
+	if jitter := viper.GetDuration("tm1-v12.poll.jitter"); jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return delay
+}
+
+func pollServers(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		if err := refreshServersShared(); err != nil {
+			logger.Error("Unable to refresh servers list", zap.Error(err))
+		}
+
+		delay := nextPollDelay()
+		logger.Debug("Next poll of the TM1 v12 databases scheduled", zap.Duration("delay", delay))
+		timer := time.NewTimer(delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Start polling the TM1 v12 service for databases in the background
+func startServersPoller() {
+	pollerStop = make(chan struct{})
+	pollerDone = make(chan struct{})
+	go pollServers(pollerStop, pollerDone)
+}
+
+// Stop polling, waiting for a refresh that might be in progress to complete
+func stopServersPoller() {
+	if pollerStop == nil {
+		return
+	}
+	close(pollerStop)
+	<-pollerDone
+	pollerStop = nil
+}
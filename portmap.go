@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// File in which we persist our server to port map
+const portMapFilePath = "servers.json"
+
+// Version of the port map file format, version 1 being the plain dictionary of ports by server name
+const portMapVersion = 2
+
+// How far the last seen time of a server may lag behind before it gets persisted, so we don't write the port map
+// file every time we poll the databases
+const portMapLastSeenResolution = time.Hour
+
+// Define a struct for the port assigned to a server, as persisted in the port map file
+type portMapEntry struct {
+	Port          int       `json:"port"`
+	FirstAssigned time.Time `json:"first-assigned"`
+	LastSeen      time.Time `json:"last-seen"`
+	Pinned        bool      `json:"pinned,omitempty"`
+}
+
+// Define a struct for the port map file
+type portMapDocument struct {
+	Version int                      `json:"version"`
+	Ports   map[string]*portMapEntry `json:"ports"`
+}
+
+var (
+	portMapEntries       = map[string]*portMapEntry{}
+	dictServerByPort     = map[int]string{}
+	portLast         int = 0
+
+	portMapWatcher *fsnotify.Watcher
+	portMapChanged bool     = false
+	portMapSynced  [32]byte // Hash of the port map file as we last read or wrote it
+)
+
+// Parse the port map file, migrating the plain dictionary of version 1 if need be, in which case migrated is true
+func parsePortMap(data []byte) (entries map[string]*portMapEntry, migrated bool, err error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, false, err
+	}
+
+	// Version 1 was a plain dictionary of ports by server name, which could have a server named version or ports
+	entries = map[string]*portMapEntry{}
+	if version, versioned := probe["version"]; versioned && len(probe["ports"]) > 0 && probe["ports"][0] == '{' {
+		var document portMapDocument
+		if err := json.Unmarshal(data, &document); err != nil {
+			return nil, false, err
+		}
+		if document.Version > portMapVersion {
+			return nil, false, errors.New("port map file version " + string(version) + " not supported, it was written by a newer version")
+		}
+		for server, entry := range document.Ports {
+			if entry != nil {
+				entries[server] = entry
+			}
+		}
+	} else {
+		var portMap map[string]int
+		if err := json.Unmarshal(data, &portMap); err != nil {
+			return nil, false, err
+		}
+		migrated = true
+		now := time.Now().UTC()
+		for server, port := range portMap {
+			entries[server] = &portMapEntry{Port: port, FirstAssigned: now, LastSeen: now}
+		}
+	}
+
+	// Every port can only be assigned to one server
+	servers := map[int]string{}
+	for server, entry := range entries {
+		if entry.Port <= 0 || entry.Port > 65535 {
+			return nil, false, errors.New("invalid port " + strconv.Itoa(entry.Port) + " assigned to server '" + server + "'")
+		}
+		if other, exists := servers[entry.Port]; exists {
+			return nil, false, errors.New("port " + strconv.Itoa(entry.Port) + " assigned to both server '" + server + "' and server '" + other + "'")
+		}
+		servers[entry.Port] = server
+	}
+	return entries, migrated, nil
+}
+
+// Read the port map file, returning an empty port map if there is none yet along with the hash of the file
+func readPortMapFile() (map[string]*portMapEntry, [32]byte, error) {
+	data, err := os.ReadFile(portMapFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]*portMapEntry{}, [32]byte{}, nil
+	} else if err != nil {
+		return nil, [32]byte{}, err
+	}
+	entries, _, err := parsePortMap(data)
+	if err != nil {
+		return nil, [32]byte{}, err
+	}
+	return entries, sha256.Sum256(data), nil
+}
+
+// Write the port map file, replacing it in one go so a crash never leaves a partially written file behind
+func writePortMapFile(entries map[string]*portMapEntry) ([32]byte, error) {
+	data, err := json.MarshalIndent(portMapDocument{Version: portMapVersion, Ports: entries}, "", "  ")
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if err := writeFileAtomically(portMapFilePath, data); err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// Write the data to a temporary file next to the file and make sure it is on disk before renaming it, so the file is
+// never left partially written. The file is only accessible to the user we run as.
+func writeFileAtomically(filePath string, data []byte) error {
+	dir := filepath.Dir(filePath)
+	file, err := os.CreateTemp(dir, "."+filepath.Base(filePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return err
+	}
+
+	// Make sure the rename is on disk as well, not every platform allows syncing a directory
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Lock the port map file for use by this process only, returning the function to unlock it again
+func lockPortMapFile() (func(), error) {
+	file, err := os.OpenFile(portMapFilePath+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// Apply changes to the port map file while holding the lock on it, a running service picks up the changes
+func updatePortMapFile(update func(entries map[string]*portMapEntry) error) error {
+	unlock, err := lockPortMapFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, _, err := readPortMapFile()
+	if err != nil {
+		return err
+	}
+	if err := update(entries); err != nil {
+		return err
+	}
+	_, err = writePortMapFile(entries)
+	return err
+}
+
+// Replace the port map. Callers need to hold mu.
+func setPortMapLocked(entries map[string]*portMapEntry) {
+	portMapEntries = entries
+	dictServerByPort = make(map[int]string)
+	for server, entry := range entries {
+		dictServerByPort[entry.Port] = server
+	}
+}
+
+// Assign a port to a server. Callers need to hold mu.
+func assignPortMapEntryLocked(server string, port int) {
+	now := time.Now().UTC()
+	entry, exists := portMapEntries[server]
+	if exists && entry.Port == port {
+		entry.LastSeen = now
+		portMapChanged = true
+		return
+	}
+	if exists && dictServerByPort[entry.Port] == server {
+		delete(dictServerByPort, entry.Port)
+	}
+	if other, exists := dictServerByPort[port]; exists {
+		delete(portMapEntries, other)
+	}
+	portMapEntries[server] = &portMapEntry{Port: port, FirstAssigned: now, LastSeen: now}
+	dictServerByPort[port] = server
+	portMapChanged = true
+}
+
+// Remove the port assigned to a server. Callers need to hold mu.
+func removePortMapEntryLocked(server string) {
+	if entry, exists := portMapEntries[server]; exists {
+		if dictServerByPort[entry.Port] == server {
+			delete(dictServerByPort, entry.Port)
+		}
+		delete(portMapEntries, server)
+		portMapChanged = true
+	}
+}
+
+// Record that we have seen the server. Callers need to hold mu.
+func touchPortMapEntryLocked(server string) {
+	if entry, exists := portMapEntries[server]; exists {
+		if now := time.Now().UTC(); now.Sub(entry.LastSeen) >= portMapLastSeenResolution {
+			entry.LastSeen = now
+			portMapChanged = true
+		}
+	}
+}
+
+// Release the ports of servers we haven't seen for longer than configured, unless pinned. Callers need to hold mu.
+func collectPortMapGarbageLocked() {
+	gcAfter := viper.GetDuration("servers.port-map.gc-after")
+	if gcAfter <= 0 {
+		return
+	}
+	for server, entry := range portMapEntries {
+		_, active := activeServersByName[server]
+		if _, pinned := pinnedPortLocked(server); active || pinned {
+			continue
+		}
+		if time.Since(entry.LastSeen) > gcAfter {
+			logger.Info("Releasing port of server not seen for a while", zap.String("server", server), zap.Int("port", entry.Port), zap.Time("last-seen", entry.LastSeen))
+			removePortMapEntryLocked(server)
+		}
+	}
+}
+
+// Persist the port map, if it changed. Changes made to the file by another process since we last read it are
+// merged, our own entries win for the servers we are actively serving. The file is locked and written without holding
+// mu, as waiting for another process to release the file shouldn't hold up serving clients.
+func savePortMapToFile() {
+	// Only update if required
+	mu.Lock()
+	changed := portMapChanged
+	mu.Unlock()
+	if !changed {
+		return
+	}
+
+	unlock, err := lockPortMapFile()
+	if err != nil {
+		logger.Error("Error locking port map file", zap.Error(err))
+		return
+	}
+	defer unlock()
+	entries, hash, err := readPortMapFile()
+
+	// Merge any changes made by others since we last read the file and take a snapshot of the result to write
+	mu.Lock()
+	if !portMapChanged {
+		mu.Unlock()
+		return
+	}
+	if err != nil {
+		logger.Error("Error reading port map from file, overwriting it", zap.Error(err))
+	} else if hash != portMapSynced {
+		for server := range activeServersByName {
+			entry, exists := portMapEntries[server]
+			if !exists {
+				continue
+			}
+			if other, conflict := findPortMapEntry(entries, entry.Port); conflict && other != server {
+				logger.Warn("Port assigned to another server in the port map file, but in use by this server", zap.String("server", server), zap.Int("port", entry.Port), zap.String("other-server", other))
+				delete(entries, other)
+			}
+			entries[server] = entry
+		}
+		setPortMapLocked(entries)
+	}
+	snapshot := make(map[string]*portMapEntry, len(portMapEntries))
+	for server, entry := range portMapEntries {
+		copied := *entry
+		snapshot[server] = &copied
+	}
+	portMapChanged = false
+	mu.Unlock()
+
+	// Write the port map to file, making sure we try again next time if that failed
+	hash, err = writePortMapFile(snapshot)
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		logger.Error("Error writing port map to file", zap.Error(err))
+		portMapChanged = true
+		return
+	}
+	portMapSynced = hash
+}
+
+// Returns the server the port is assigned to in the port map
+func findPortMapEntry(entries map[string]*portMapEntry, port int) (string, bool) {
+	for server, entry := range entries {
+		if entry.Port == port {
+			return server, true
+		}
+	}
+	return "", false
+}
+
+// Reload the port map from file, unless it is the file as we last read or wrote it. The file is locked while reading
+// it, so a write of our own is never mistaken for a change by someone else before we recorded what we wrote.
+func updatePortMapFromFile() bool {
+	unlock, err := lockPortMapFile()
+	if err != nil {
+		logger.Error("Error locking port map file", zap.Error(err))
+		return false
+	}
+	defer unlock()
+	entries, hash, err := readPortMapFile()
+	if err != nil {
+		logger.Error("Error reading port map from file", zap.Error(err))
+		return false
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hash == portMapSynced {
+		return false
+	}
+	setPortMapLocked(entries)
+	portMapSynced = hash
+	reconcilePinnedPortsLocked()
+	return true
+}
+
+func watchPortMapFile() {
+	name := filepath.Clean(portMapFilePath)
+	for {
+		select {
+		case event, ok := <-portMapWatcher.Events:
+			if !ok {
+				return
+			}
+
+			// Reload the file if it got replaced or modified, writes of our own are recognized by their content
+			if filepath.Clean(event.Name) == name && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				if updatePortMapFromFile() {
+					logger.Info("Servers port map reloaded")
+				}
+			}
+		case err, ok := <-portMapWatcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("Servers file watcher error", zap.Error(err))
+		}
+	}
+}
+
+func initPortMap() {
+	// Initialize the port map from file, a port map in an older format gets upgraded the next time we save it
+	data, err := os.ReadFile(portMapFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("Error reading port map from file", zap.Error(err))
+	}
+	if err == nil {
+		entries, migrated, err := parsePortMap(data)
+		if err != nil {
+			logger.Error("Error reading port map from file, starting with an empty port map", zap.Error(err))
+		} else {
+			mu.Lock()
+			setPortMapLocked(entries)
+			portMapSynced = sha256.Sum256(data)
+			portMapChanged = migrated
+			reconcilePinnedPortsLocked()
+			mu.Unlock()
+		}
+	} else {
+		// There is none yet, start with an empty one
+		mu.Lock()
+		portMapChanged = true
+		mu.Unlock()
+		savePortMapToFile()
+	}
+
+	// Set up a watcher for the directory of the servers file, as the file gets replaced rather than written
+	portMapWatcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("Failed to initialize servers file watcher", zap.Error(err))
+		return
+	}
+	if err = portMapWatcher.Add(filepath.Dir(portMapFilePath)); err != nil {
+		logger.Error("Failed to start watching the servers file", zap.Error((err)))
+	}
+
+	// Start watching the servers file
+	go watchPortMapFile()
+}
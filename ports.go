@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Define a struct for a range of ports used by the servers
+type portRange struct {
+	Min int `mapstructure:"min"`
+	Max int `mapstructure:"max"`
+}
+
+// Define a struct for a port pinned to a server in the configuration
+type pinnedPort struct {
+	Server string `mapstructure:"server"`
+	Port   int    `mapstructure:"port"`
+}
+
+// Build the ports servers get assigned from the port ranges, excluded ports and pinned ports
+func buildPortConfig() error {
+	var errs []error
+
+	// Use the port ranges if specified, the single port range otherwise
+	var ranges []portRange
+	if err := viper.UnmarshalKey("servers.port-ranges", &ranges); err != nil {
+		logger.Error("Invalid port ranges specified! Falling back to using the port range!", zap.Error(err))
+		ranges = nil
+	}
+	valid := ranges[:0]
+	for _, r := range ranges {
+		if r.Min <= 0 || r.Max > 65535 || r.Min > r.Max {
+			logger.Error("Invalid port range specified, ignoring it!", zap.Int("min", r.Min), zap.Int("max", r.Max))
+			continue
+		}
+		valid = append(valid, r)
+	}
+	if len(valid) == 0 {
+		valid = append(valid, portRange{Min: viper.GetInt("servers.port-range.min"), Max: viper.GetInt("servers.port-range.max")})
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].Min < valid[j].Min })
+	viper.Set("servers.port-ranges$", valid)
+
+	// Ports that are never assigned
+	excluded := map[int]bool{}
+	for _, port := range viper.GetIntSlice("servers.excluded-ports") {
+		excluded[port] = true
+	}
+	viper.Set("servers.excluded-ports$", excluded)
+
+	// Ports pinned to servers, which may be outside of the port ranges but can't be excluded or pinned twice
+	var pins []pinnedPort
+	if err := viper.UnmarshalKey("servers.pinned-ports", &pins); err != nil {
+		errs = append(errs, newConfigError("Invalid pinned ports specified", zap.Error(err)))
+	}
+	pinnedByServer := map[string]int{}
+	pinnedByPort := map[int]string{}
+	for _, pin := range pins {
+		if pin.Server == "" || pin.Port <= 0 || pin.Port > 65535 {
+			errs = append(errs, newConfigError("Invalid pinned port specified: every pinned port requires a server name and a valid port", zap.String("server", pin.Server), zap.Int("port", pin.Port)))
+			continue
+		}
+		if excluded[pin.Port] {
+			errs = append(errs, newConfigError("Invalid pinned port specified: port is excluded", zap.String("server", pin.Server), zap.Int("port", pin.Port)))
+			continue
+		}
+		if other, exists := pinnedByPort[pin.Port]; exists {
+			errs = append(errs, newConfigError("Invalid pinned port specified: port is pinned to another server already", zap.String("server", pin.Server), zap.Int("port", pin.Port), zap.String("other-server", other)))
+			continue
+		}
+		if _, exists := pinnedByServer[pin.Server]; exists {
+			errs = append(errs, newConfigError("Invalid pinned port specified: server has a port pinned to it already", zap.String("server", pin.Server), zap.Int("port", pin.Port)))
+			continue
+		}
+		pinnedByServer[pin.Server] = pin.Port
+		pinnedByPort[pin.Port] = pin.Server
+	}
+	viper.Set("servers.pinned-ports$", pinnedByServer)
+
+	// Pinned ports in the port map file are overruled by those in the configuration, the port map is reconciled again
+	// whenever it gets loaded from file
+	mu.Lock()
+	reconcilePinnedPortsLocked()
+	mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// Unpin the ports pinned to a server in the port map that are pinned to another server in the configuration, as the
+// configuration takes precedence. Callers need to hold mu.
+func reconcilePinnedPortsLocked() {
+	pins, _ := viper.Get("servers.pinned-ports$").(map[string]int)
+	for server, port := range pins {
+		if other, exists := dictServerByPort[port]; exists && other != server && portMapEntries[other].Pinned {
+			logger.Warn("Port pinned to server in the configuration is pinned to another server in the port map file, unpinning it", zap.String("server", server), zap.Int("port", port), zap.String("other-server", other))
+			portMapEntries[other].Pinned = false
+			portMapChanged = true
+		}
+	}
+}
+
+// Returns the port pinned to a server, either in the configuration or in the port map. Callers need to hold mu.
+func pinnedPortLocked(server string) (int, bool) {
+	pins, _ := viper.Get("servers.pinned-ports$").(map[string]int)
+	if port, pinned := pins[server]; pinned {
+		return port, true
+	}
+	if entry, exists := portMapEntries[server]; exists && entry.Pinned {
+		return entry.Port, true
+	}
+	return 0, false
+}
+
+// Returns true if the port is pinned to a server other than the specified one. Callers need to hold mu.
+func isPortPinnedToOtherLocked(port int, server string) bool {
+	pins, _ := viper.Get("servers.pinned-ports$").(map[string]int)
+	for other, pinned := range pins {
+		if pinned == port && other != server {
+			return true
+		}
+	}
+	other, exists := dictServerByPort[port]
+	return exists && other != server && portMapEntries[other].Pinned
+}
+
+// Returns the ports, in ascending order, servers get assigned from, leaving out the excluded ports
+func assignablePorts() []int {
+	ranges, _ := viper.Get("servers.port-ranges$").([]portRange)
+	excluded, _ := viper.Get("servers.excluded-ports$").(map[int]bool)
+	ports := []int{}
+	for _, r := range ranges {
+		for port := r.Min; port <= r.Max; port++ {
+			if !excluded[port] && (len(ports) == 0 || port > ports[len(ports)-1]) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
+
+// Returns true if the port is one of the ports servers get assigned from
+func isAssignablePort(port int) bool {
+	ranges, _ := viper.Get("servers.port-ranges$").([]portRange)
+	excluded, _ := viper.Get("servers.excluded-ports$").(map[int]bool)
+	if excluded[port] {
+		return false
+	}
+	for _, r := range ranges {
+		if port >= r.Min && port <= r.Max {
+			return true
+		}
+	}
+	return false
+}
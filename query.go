@@ -0,0 +1,637 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Define a struct holding the OData system query options applicable to the Servers entity set
+type serverQuery struct {
+	selectProperties []string
+	filter           filterExpr
+	orderBy          []orderByItem
+	top              int
+	skip             int
+	count            bool
+	deltaToken       string
+}
+
+type orderByItem struct {
+	property   string
+	descending bool
+}
+
+// Define an error type capturing why a query could not be processed and the status it maps to
+type queryError struct {
+	statusCode int
+	code       string
+	message    string
+}
+
+func (e *queryError) Error() string {
+	return e.message
+}
+
+func badQuery(format string, args ...interface{}) *queryError {
+	return &queryError{statusCode: http.StatusBadRequest, code: errorCodeInvalidQuery, message: fmt.Sprintf(format, args...)}
+}
+
+// System query options we know about but do not implement, as per the OData spec these result in a 501
+var unsupportedQueryOptions = map[string]bool{
+	"$expand":        true,
+	"$search":        true,
+	"$apply":         true,
+	"$compute":       true,
+	"$index":         true,
+	"$levels":        true,
+	"$skiptoken":     true,
+	"$schemaversion": true,
+}
+
+// The property names of the Server entity type, in declaration order, and the EDM type they map to
+var serverPropertyNames, serverPropertyTypes = func() ([]string, map[string]string) {
+	names := []string{}
+	types := map[string]string{}
+	t := reflect.TypeOf(Server{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || field.Tag.Get("json") == "-" {
+			continue
+		}
+		names = append(names, field.Name)
+		switch field.Type.Kind() {
+		case reflect.Bool:
+			types[field.Name] = "Edm.Boolean"
+		case reflect.Int:
+			types[field.Name] = "Edm.Int32"
+		default:
+			types[field.Name] = "Edm.String"
+		}
+	}
+	return names, types
+}()
+
+// Returns the value of a server property as used in query evaluation, nullable properties that aren't set return nil
+func serverPropertyValue(server *Server, name string) interface{} {
+	value := reflect.ValueOf(server).Elem().FieldByName(name)
+	switch v := value.Interface().(type) {
+	case NullableString:
+		if v == "" {
+			return nil
+		}
+		return string(v)
+	case NullableInt:
+		if v == 0 {
+			return nil
+		}
+		return int(v)
+	default:
+		return v
+	}
+}
+
+// Parses the system query options in the query string, options only applicable to collections are
+// rejected when the request targets a single entity
+func parseServerQuery(values url.Values, collection bool) (*serverQuery, *queryError) {
+	query := &serverQuery{top: -1}
+	for option, optionValues := range values {
+		// Custom query options, not starting with a $, are ignored
+		if !strings.HasPrefix(option, "$") {
+			continue
+		}
+		if len(optionValues) > 1 {
+			return nil, badQuery("The system query option '%s' is specified more than once", option)
+		}
+		value := optionValues[0]
+		if unsupportedQueryOptions[option] {
+			return nil, &queryError{statusCode: http.StatusNotImplemented, code: errorCodeNotImplemented, message: fmt.Sprintf("The system query option '%s' is not supported", option)}
+		}
+		if !collection && option != "$select" && option != "$format" {
+			return nil, badQuery("The system query option '%s' is not applicable to a single entity", option)
+		}
+
+		var err *queryError
+		switch option {
+		case "$select":
+			query.selectProperties, err = parseSelect(value)
+		case "$filter":
+			query.filter, err = parseFilter(value)
+		case "$orderby":
+			query.orderBy, err = parseOrderBy(value)
+		case "$top":
+			query.top, err = parseNonNegativeInt(option, value)
+		case "$skip":
+			query.skip, err = parseNonNegativeInt(option, value)
+		case "$count":
+			switch value {
+			case "true":
+				query.count = true
+			case "false":
+				query.count = false
+			default:
+				err = badQuery("Invalid value '%s' for $count, expected true or false", value)
+			}
+		case "$deltatoken":
+			query.deltaToken = value
+		case "$format":
+			if value != "json" && !strings.HasPrefix(value, "application/json") {
+				err = &queryError{statusCode: http.StatusNotAcceptable, code: errorCodeUnsupportedFormat, message: fmt.Sprintf("The format '%s' specified in $format is not supported", value)}
+			}
+		default:
+			err = badQuery("Unknown system query option '%s'", option)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Changes are tracked for the servers matching the filter, they can't be paged or ordered
+	if query.deltaToken != "" && !query.tracksChanges() {
+		return nil, badQuery("The system query option '$deltatoken' can only be combined with '$filter' and '$select'")
+	}
+	return query, nil
+}
+
+// Returns true if changes can be tracked for the query, which is the case unless it pages, orders or counts
+func (query *serverQuery) tracksChanges() bool {
+	return query.top < 0 && query.skip == 0 && len(query.orderBy) == 0 && !query.count
+}
+
+// Returns true if the server matches the filter, if any
+func (query *serverQuery) matches(server *Server) bool {
+	return query.filter == nil || query.filter.eval(server) == true
+}
+
+func parseNonNegativeInt(option string, value string) (int, *queryError) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, badQuery("Invalid value '%s' for %s, expected a non-negative integer", value, option)
+	}
+	return n, nil
+}
+
+func parseSelect(value string) ([]string, *queryError) {
+	// A '*' selects all properties, same as not specifying $select at all
+	properties := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "*" {
+			return nil, nil
+		}
+		if _, exists := serverPropertyTypes[item]; !exists {
+			return nil, badQuery("Could not find a property named '%s' on type 'tm1.Server'", item)
+		}
+		properties = append(properties, item)
+	}
+	return properties, nil
+}
+
+func parseOrderBy(value string) ([]orderByItem, *queryError) {
+	items := []orderByItem{}
+	for _, item := range strings.Split(value, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, badQuery("Invalid $orderby expression '%s'", strings.TrimSpace(item))
+		}
+		if _, exists := serverPropertyTypes[fields[0]]; !exists {
+			return nil, badQuery("Could not find a property named '%s' on type 'tm1.Server'", fields[0])
+		}
+		orderBy := orderByItem{property: fields[0]}
+		if len(fields) == 2 {
+			switch fields[1] {
+			case "asc":
+			case "desc":
+				orderBy.descending = true
+			default:
+				return nil, badQuery("Invalid sort direction '%s' in $orderby, expected asc or desc", fields[1])
+			}
+		}
+		items = append(items, orderBy)
+	}
+	return items, nil
+}
+
+// Applies the filter, ordering and paging to the list of servers, returning the count of matching
+// servers before paging got applied next to the resulting list of servers
+func (query *serverQuery) apply(servers []Server) ([]Server, int) {
+	// Filter the servers
+	result := []Server{}
+	for i := range servers {
+		if query.matches(&servers[i]) {
+			result = append(result, servers[i])
+		}
+	}
+	count := len(result)
+
+	// Order the servers, by name by default so paging results are stable
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	if len(query.orderBy) > 0 {
+		sort.SliceStable(result, func(i, j int) bool {
+			for _, item := range query.orderBy {
+				c, _ := compareValues(serverPropertyValue(&result[i], item.property), serverPropertyValue(&result[j], item.property))
+				if c != 0 {
+					return (c < 0) != item.descending
+				}
+			}
+			return false
+		})
+	}
+
+	// Page the servers
+	if query.skip >= len(result) {
+		result = []Server{}
+	} else {
+		result = result[query.skip:]
+	}
+	if query.top >= 0 && query.top < len(result) {
+		result = result[:query.top]
+	}
+	return result, count
+}
+
+// Returns the context URL fragment describing the selected properties, if any
+func (query *serverQuery) selectContext() string {
+	if len(query.selectProperties) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(query.selectProperties, ",") + ")"
+}
+
+// Compares two values, nil sorting before any other value, and returns false if they aren't comparable
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0, true
+		case a == nil:
+			return -1, true
+		default:
+			return 1, true
+		}
+	}
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case int:
+		if bv, ok := b.(int); ok {
+			switch {
+			case av < bv:
+				return -1, true
+			case av > bv:
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0, true
+			case !av:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+// Define the nodes making up a parsed $filter expression
+type filterExpr interface {
+	edmType() string
+	eval(server *Server) interface{}
+}
+
+type literalExpr struct {
+	value interface{}
+	typ   string
+}
+
+func (e *literalExpr) edmType() string                 { return e.typ }
+func (e *literalExpr) eval(server *Server) interface{} { return e.value }
+
+type propertyExpr struct {
+	name string
+}
+
+func (e *propertyExpr) edmType() string                 { return serverPropertyTypes[e.name] }
+func (e *propertyExpr) eval(server *Server) interface{} { return serverPropertyValue(server, e.name) }
+
+type notExpr struct {
+	operand filterExpr
+}
+
+func (e *notExpr) edmType() string { return "Edm.Boolean" }
+func (e *notExpr) eval(server *Server) interface{} {
+	value, ok := e.operand.eval(server).(bool)
+	return ok && !value
+}
+
+type binaryExpr struct {
+	op    string
+	left  filterExpr
+	right filterExpr
+}
+
+func (e *binaryExpr) edmType() string { return "Edm.Boolean" }
+func (e *binaryExpr) eval(server *Server) interface{} {
+	switch e.op {
+	case "and":
+		return e.left.eval(server) == true && e.right.eval(server) == true
+	case "or":
+		return e.left.eval(server) == true || e.right.eval(server) == true
+	}
+	left := e.left.eval(server)
+	right := e.right.eval(server)
+	c, ok := compareValues(left, right)
+	switch e.op {
+	case "eq":
+		return ok && c == 0
+	case "ne":
+		return !ok || c != 0
+	}
+	// Ordering comparisons involving null are always false
+	if !ok || left == nil || right == nil {
+		return false
+	}
+	switch e.op {
+	case "gt":
+		return c > 0
+	case "ge":
+		return c >= 0
+	case "lt":
+		return c < 0
+	case "le":
+		return c <= 0
+	}
+	return false
+}
+
+type functionExpr struct {
+	name string
+	args []filterExpr
+}
+
+func (e *functionExpr) edmType() string { return "Edm.Boolean" }
+func (e *functionExpr) eval(server *Server) interface{} {
+	value, ok1 := e.args[0].eval(server).(string)
+	search, ok2 := e.args[1].eval(server).(string)
+	if !ok1 || !ok2 {
+		return false
+	}
+	switch e.name {
+	case "contains":
+		return strings.Contains(value, search)
+	case "startswith":
+		return strings.HasPrefix(value, search)
+	case "endswith":
+		return strings.HasSuffix(value, search)
+	}
+	return false
+}
+
+// Define a parser for $filter expressions, supporting comparisons, logical operators and
+// the contains, startswith and endswith string functions
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseFilter(value string) (filterExpr, *queryError) {
+	tokens, err := tokenizeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, badQuery("Syntax error at '%s' in $filter expression", parser.tokens[parser.pos])
+	}
+	if expr.edmType() != "Edm.Boolean" {
+		return nil, badQuery("The $filter expression must evaluate to a boolean")
+	}
+	return expr, nil
+}
+
+func tokenizeFilter(value string) ([]string, *queryError) {
+	tokens := []string{}
+	runes := []rune(value)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '\'':
+			// String literal, a single quote inside is escaped by doubling it
+			var literal strings.Builder
+			literal.WriteRune('\'')
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, badQuery("Unterminated string literal in $filter expression")
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						literal.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				literal.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, literal.String())
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' && runes[i] != ',' && runes[i] != '\'' {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		}
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *filterParser) expect(token string) *queryError {
+	if p.peek() != token {
+		if p.pos >= len(p.tokens) {
+			return badQuery("Unexpected end of $filter expression, expected '%s'", token)
+		}
+		return badQuery("Syntax error at '%s' in $filter expression, expected '%s'", p.peek(), token)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterExpr, *queryError) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if left.edmType() != "Edm.Boolean" || right.edmType() != "Edm.Boolean" {
+			return nil, badQuery("The operands of 'or' must be boolean expressions")
+		}
+		left = &binaryExpr{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, *queryError) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if left.edmType() != "Edm.Boolean" || right.edmType() != "Edm.Boolean" {
+			return nil, badQuery("The operands of 'and' must be boolean expressions")
+		}
+		left = &binaryExpr{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterExpr, *queryError) {
+	if p.peek() == "not" {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if operand.edmType() != "Edm.Boolean" {
+			return nil, badQuery("The operand of 'not' must be a boolean expression")
+		}
+		return &notExpr{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterExpr, *queryError) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch op {
+	case "eq", "ne", "gt", "ge", "lt", "le":
+		p.next()
+	default:
+		return left, nil
+	}
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	// Both operands need to be of the same type, null being comparable with anything
+	leftType, rightType := left.edmType(), right.edmType()
+	if leftType != "null" && rightType != "null" && leftType != rightType {
+		return nil, badQuery("Operator '%s' cannot be applied to operands of type '%s' and '%s'", op, leftType, rightType)
+	}
+	if op != "eq" && op != "ne" && (leftType == "Edm.Boolean" || rightType == "Edm.Boolean") {
+		return nil, badQuery("Operator '%s' cannot be applied to boolean operands", op)
+	}
+	return &binaryExpr{op: op, left: left, right: right}, nil
+}
+
+func (p *filterParser) parsePrimary() (filterExpr, *queryError) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, badQuery("Unexpected end of $filter expression")
+	case token == "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case strings.HasPrefix(token, "'"):
+		return &literalExpr{value: token[1:], typ: "Edm.String"}, nil
+	case token == "true" || token == "false":
+		return &literalExpr{value: token == "true", typ: "Edm.Boolean"}, nil
+	case token == "null":
+		return &literalExpr{value: nil, typ: "null"}, nil
+	case p.peek() == "(":
+		return p.parseFunction(token)
+	}
+	if n, err := strconv.Atoi(token); err == nil {
+		return &literalExpr{value: n, typ: "Edm.Int32"}, nil
+	}
+	if _, exists := serverPropertyTypes[token]; exists {
+		return &propertyExpr{name: token}, nil
+	}
+	return nil, badQuery("Could not find a property named '%s' on type 'tm1.Server'", token)
+}
+
+func (p *filterParser) parseFunction(name string) (filterExpr, *queryError) {
+	if name != "contains" && name != "startswith" && name != "endswith" {
+		return nil, &queryError{statusCode: http.StatusNotImplemented, code: errorCodeNotImplemented, message: fmt.Sprintf("The function '%s' is not supported in $filter expressions", name)}
+	}
+	p.next()
+	args := []filterExpr{}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if arg.edmType() != "Edm.String" {
+			return nil, badQuery("The arguments of function '%s' must be strings", name)
+		}
+		args = append(args, arg)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if len(args) != 2 {
+		return nil, badQuery("The function '%s' expects 2 arguments", name)
+	}
+	return &functionExpr{name: name, args: args}, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// Servers the queries are evaluated against
+var queryTestServers = []Server{
+	{Name: "Sales", HTTPPortNumber: 9601, AcceptingClients: true, IPAddress: "10.0.0.1", UsingSSL: true},
+	{Name: "Planning", HTTPPortNumber: 9603, AcceptingClients: true},
+	{Name: "Budget", HTTPPortNumber: 9602, AcceptingClients: false, IPAddress: "10.0.0.2"},
+	{Name: "SalesArchive", HTTPPortNumber: 9604, AcceptingClients: false},
+	{Name: "It's", HTTPPortNumber: 9605, AcceptingClients: true},
+}
+
+func serverNames(servers []Server) []string {
+	names := []string{}
+	for _, server := range servers {
+		names = append(names, server.Name)
+	}
+	return names
+}
+
+func TestParseServerQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		collection bool
+		check      func(query *serverQuery) bool
+	}{
+		{"no options", "", true, func(q *serverQuery) bool {
+			return q.filter == nil && q.top == -1 && q.skip == 0 && !q.count && q.tracksChanges()
+		}},
+		{"custom options are ignored", "refresh=true&foo=bar", true, func(q *serverQuery) bool { return q.filter == nil }},
+		{"select", "$select=Name, HTTPPortNumber", true, func(q *serverQuery) bool {
+			return slices.Equal(q.selectProperties, []string{"Name", "HTTPPortNumber"}) && q.selectContext() == "(Name,HTTPPortNumber)"
+		}},
+		{"select all", "$select=Name,*", true, func(q *serverQuery) bool { return q.selectProperties == nil && q.selectContext() == "" }},
+		{"paging", "$top=2&$skip=1&$count=true", true, func(q *serverQuery) bool { return q.top == 2 && q.skip == 1 && q.count && !q.tracksChanges() }},
+		{"orderby", "$orderby=AcceptingClients desc,Name", true, func(q *serverQuery) bool {
+			return slices.Equal(q.orderBy, []orderByItem{{property: "AcceptingClients", descending: true}, {property: "Name"}})
+		}},
+		{"format", "$format=application/json;odata.metadata=minimal", true, func(q *serverQuery) bool { return true }},
+		{"delta token", "$deltatoken=abc.1&$filter=AcceptingClients", true, func(q *serverQuery) bool { return q.deltaToken == "abc.1" && q.filter != nil }},
+		{"single entity select", "$select=Name", false, func(q *serverQuery) bool { return slices.Equal(q.selectProperties, []string{"Name"}) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			query, err := parseServerQuery(values, test.collection)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !test.check(query) {
+				t.Errorf("unexpected query %+v", query)
+			}
+		})
+	}
+}
+
+func TestParseServerQueryErrors(t *testing.T) {
+	tests := []struct {
+		query      string
+		collection bool
+		statusCode int
+		code       string
+	}{
+		{"$expand=Sessions", true, http.StatusNotImplemented, errorCodeNotImplemented},
+		{"$search=sales", true, http.StatusNotImplemented, errorCodeNotImplemented},
+		{"$filter=tolower(Name) eq 'sales'", true, http.StatusNotImplemented, errorCodeNotImplemented},
+		{"$format=xml", true, http.StatusNotAcceptable, errorCodeUnsupportedFormat},
+		{"$format=atom", false, http.StatusNotAcceptable, errorCodeUnsupportedFormat},
+		{"$top=-1", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$skip=many", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$count=yes", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$top=1&$top=2", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$select=Colour", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$orderby=Name sideways", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$orderby=Colour", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$unknown=1", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=Name", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=Name eq 1", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=AcceptingClients gt false", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=Name eq 'Sales", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=(Name eq 'Sales'", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=Name eq 'Sales' Name", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=Colour eq 'red'", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=not Name", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=contains(Name)", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=contains(Name,1)", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$deltatoken=abc.1&$top=1", true, http.StatusBadRequest, errorCodeInvalidQuery},
+		{"$filter=AcceptingClients", false, http.StatusBadRequest, errorCodeInvalidQuery},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		_, err := parseServerQuery(values, test.collection)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.query)
+			continue
+		}
+		if err.statusCode != test.statusCode || err.code != test.code {
+			t.Errorf("%s: expected %d %s, got %d %s (%s)", test.query, test.statusCode, test.code, err.statusCode, err.code, err.message)
+		}
+	}
+}
+
+func TestServerQueryApply(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []string
+		count    int
+	}{
+		{"", []string{"Budget", "It's", "Planning", "Sales", "SalesArchive"}, 5},
+		{"$filter=Name eq 'Sales'", []string{"Sales"}, 1},
+		{"$filter=Name ne 'Sales'", []string{"Budget", "It's", "Planning", "SalesArchive"}, 4},
+		{"$filter=Name eq 'It''s'", []string{"It's"}, 1},
+		{"$filter=startswith(Name,'Sales')", []string{"Sales", "SalesArchive"}, 2},
+		{"$filter=endswith(Name,'ing')", []string{"Planning"}, 1},
+		{"$filter=contains(Name,'an')", []string{"Planning"}, 1},
+		{"$filter=AcceptingClients", []string{"It's", "Planning", "Sales"}, 3},
+		{"$filter=not AcceptingClients", []string{"Budget", "SalesArchive"}, 2},
+		{"$filter=AcceptingClients eq false and startswith(Name,'Sales')", []string{"SalesArchive"}, 1},
+		{"$filter=Name eq 'Budget' or (UsingSSL and HTTPPortNumber lt 9602)", []string{"Budget", "Sales"}, 2},
+		{"$filter=HTTPPortNumber ge 9603", []string{"It's", "Planning", "SalesArchive"}, 3},
+		{"$filter=IPAddress eq null", []string{"It's", "Planning", "SalesArchive"}, 3},
+		{"$filter=IPAddress ne null", []string{"Budget", "Sales"}, 2},
+		{"$filter=IPAddress gt '10.0.0.1'", []string{"Budget"}, 1},
+		{"$orderby=HTTPPortNumber desc", []string{"It's", "SalesArchive", "Planning", "Budget", "Sales"}, 5},
+		{"$orderby=AcceptingClients,Name desc", []string{"SalesArchive", "Budget", "Sales", "Planning", "It's"}, 5},
+		{"$orderby=IPAddress", []string{"It's", "Planning", "SalesArchive", "Sales", "Budget"}, 5},
+		{"$top=2", []string{"Budget", "It's"}, 5},
+		{"$skip=3", []string{"Sales", "SalesArchive"}, 5},
+		{"$skip=10", []string{}, 5},
+		{"$filter=AcceptingClients&$orderby=HTTPPortNumber&$skip=1&$top=1", []string{"Planning"}, 3},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		query, err := parseServerQuery(values, true)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.query, err)
+			continue
+		}
+		servers, count := query.apply(queryTestServers)
+		if names := serverNames(servers); !slices.Equal(names, test.expected) || count != test.count {
+			t.Errorf("%s: expected %v (%d), got %v (%d)", test.query, test.expected, test.count, names, count)
+		}
+	}
+}
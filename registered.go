@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Define a struct for a manually registered server, as persisted in the registered servers file
+type RegisteredServer struct {
+	Name             string
+	UpstreamURL      string
+	AcceptingClients bool
+}
+
+// Define a struct for the changes that can be applied to a manually registered server
+type RegisteredServerPatch struct {
+	UpstreamURL      *string
+	AcceptingClients *bool
+}
+
+var (
+	registeredServers = map[string]RegisteredServer{}
+
+	errServerExists        = errors.New("a server with this name exists already")
+	errServerNotFound      = errors.New("server not found")
+	errServerNotRegistered = errors.New("server was not registered manually and cannot be modified or deleted")
+	errNoPortAvailable     = errors.New("no more ports available")
+	errPinnedPortNotFree   = errors.New("port pinned to server not available")
+)
+
+// Validate the properties of a server to be registered
+func validateRegisteredServer(registered RegisteredServer) error {
+	if registered.Name == "" || strings.ContainsAny(registered.Name, "/'") {
+		return errors.New("invalid server name, a name is required and cannot contain a '/' or a quote")
+	}
+	return validateUpstreamURL(registered.UpstreamURL)
+}
+
+func validateUpstreamURL(upstreamURL string) error {
+	u, err := url.Parse(upstreamURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid upstream URL, an absolute http or https URL of the service root of the server is required")
+	}
+	return nil
+}
+
+// Save the registered servers to file. Callers need to hold mu.
+func saveRegisteredServersLocked() {
+	registered := []RegisteredServer{}
+	for _, server := range registeredServers {
+		registered = append(registered, server)
+	}
+	jsonRegistered, err := json.MarshalIndent(registered, "", "  ")
+	if err != nil {
+		logger.Error("Error marshalling registered servers to JSON", zap.Error(err))
+		return
+	}
+	if err := writeFileAtomically(viper.GetString("servers.registered-file"), jsonRegistered); err != nil {
+		logger.Error("Error writing registered servers to file", zap.Error(err), zap.String("servers.registered-file", viper.GetString("servers.registered-file")))
+	}
+}
+
+// Load the registered servers from file and start serving them
+func initRegisteredServers() {
+	jsonRegistered, err := os.ReadFile(viper.GetString("servers.registered-file"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("Error reading registered servers from file", zap.Error(err), zap.String("servers.registered-file", viper.GetString("servers.registered-file")))
+		}
+		return
+	}
+	var registered []RegisteredServer
+	if err := json.Unmarshal(jsonRegistered, &registered); err != nil {
+		logger.Error("Error unmarshalling registered servers JSON", zap.Error(err), zap.String("servers.registered-file", viper.GetString("servers.registered-file")))
+		return
+	}
+
+	mu.Lock()
+	for _, server := range registered {
+		if err := validateRegisteredServer(server); err != nil {
+			logger.Error("Ignoring invalid registered server", zap.Error(err), zap.String("server", server.Name))
+			continue
+		}
+		registeredServers[server.Name] = server
+		upsertRegisteredServer(server)
+	}
+	mu.Unlock()
+
+	// Make sure any changes made to the port map get persisted in the servers file
+	go func() {
+		savePortMapToFile()
+	}()
+}
+
+// Create or update the server representing a registered server. Callers need to hold mu.
+func upsertRegisteredServer(registered RegisteredServer) error {
+	server, exists := activeServersByName[registered.Name]
+	if !exists {
+		server = NewServer()
+		server.Name = registered.Name
+		server.SelfRegistered = false
+		server.Host = viper.GetString("servers.host-name")
+		server.IPAddress = NullableString(viper.GetString("servers.ip-v4-address$"))
+		server.IPv6Address = NullableString(viper.GetString("servers.ip-v6-address$"))
+		server.UsingSSL = viper.GetBool("servers.using-ssl")
+		setServerSSLProperties(&server)
+		server.HTTPPortNumber = assignPort(registered.Name)
+		if server.HTTPPortNumber == 0 {
+			if _, pinned := pinnedPortLocked(registered.Name); pinned {
+				return errPinnedPortNotFree
+			}
+			logger.Error("No more ports available. Please consider increasing the range of available ports!", zap.String("server", registered.Name))
+			return errNoPortAvailable
+		}
+	} else if server.upstreamURL != registered.UpstreamURL {
+		// The upstream changed, stop the proxy so it can be restarted targeting the new upstream
+		stopServer(server.Name)
+	}
+	changed := !exists || server.upstreamURL != registered.UpstreamURL || server.AcceptingClients != registered.AcceptingClients
+	if server.upstreamURL != registered.UpstreamURL || !exists {
+		server.upstreamURL = registered.UpstreamURL
+		startReverseProxy(&server)
+	}
+	server.AcceptingClients = registered.AcceptingClients
+	touchPortMapEntryLocked(server.Name)
+
+	// Only a server that actually changed counts as updated, registering it again as is doesn't
+	if changed {
+		server.LastUpdated = time.Now().Format(time.RFC3339)
+	}
+	activeServersByName[server.Name] = server
+	activeServersByPort[server.HTTPPortNumber] = server.Name
+	if changed {
+		recordServerChangeLocked(server.Name)
+	}
+	return nil
+}
+
+// Register a server manually, starting a proxy forwarding to its upstream URL
+func registerServer(registered RegisteredServer) (*Server, error) {
+	if err := validateRegisteredServer(registered); err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer func() {
+		mu.Unlock()
+
+		// Make sure any changes made to the port map get persisted in the servers file
+		go func() {
+			savePortMapToFile()
+		}()
+	}()
+
+	if _, exists := activeServersByName[registered.Name]; exists {
+		return nil, errServerExists
+	}
+	if err := upsertRegisteredServer(registered); err != nil {
+		return nil, err
+	}
+	registeredServers[registered.Name] = registered
+	saveRegisteredServersLocked()
+	logger.Info("Server registered", zap.String("server", registered.Name), zap.String("upstream-url", registered.UpstreamURL))
+
+	server := activeServersByName[registered.Name]
+	return &server, nil
+}
+
+// Apply changes to a manually registered server
+func updateRegisteredServer(name string, patch RegisteredServerPatch) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	registered, exists := registeredServers[name]
+	if !exists {
+		if _, exists := activeServersByName[name]; exists {
+			return errServerNotRegistered
+		}
+		return errServerNotFound
+	}
+	if patch.UpstreamURL != nil {
+		if err := validateUpstreamURL(*patch.UpstreamURL); err != nil {
+			return err
+		}
+		registered.UpstreamURL = *patch.UpstreamURL
+	}
+	if patch.AcceptingClients != nil {
+		registered.AcceptingClients = *patch.AcceptingClients
+	}
+	if err := upsertRegisteredServer(registered); err != nil {
+		return err
+	}
+	registeredServers[name] = registered
+	saveRegisteredServersLocked()
+	logger.Info("Registered server updated", zap.String("server", name), zap.String("upstream-url", registered.UpstreamURL), zap.Bool("accepting-clients", registered.AcceptingClients))
+	return nil
+}
+
+// Remove a manually registered server, stopping its proxy
+func unregisterServer(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, exists := registeredServers[name]; !exists {
+		if _, exists := activeServersByName[name]; exists {
+			return errServerNotRegistered
+		}
+		return errServerNotFound
+	}
+	removeServer(name)
+	delete(registeredServers, name)
+	saveRegisteredServersLocked()
+	logger.Info("Server unregistered", zap.String("server", name))
+	return nil
+}
@@ -1,59 +1,505 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
 )
 
-func handleInternalCapabilitiesResource(w http.ResponseWriter, r *http.Request) {
+// The capabilities known by the internal API, in the order the internal API returned them, mapped onto the elements
+// of the }Capabilities dimension of the database
+var legacyCapabilities = []struct {
+	name    string
+	element string
+}{
+	{"RunServerExplorer", "RunServerExplorer"},
+	{"UsePersonalWorkspaceWritebackMode", "UsePersonalWorkspaceWritebackMode"},
+	{"UseSandbox", "UseSandbox"},
+	{"ManageDataReservation", "ManageDataReservation"},
+	{"DataReservationOverride", "DataReservationOverride"},
+	{"Consolidation TypeIn Spreading", "Consolidation TypeIn Spreading"},
+	{"Allow Spreading", "Allow Spreading"},
+	{"Allow Export as Text", "Allow Export as Text"},
+}
+
+// Define the structure of the capabilities returned by the internal API
+type internalPermission struct {
+	Name   string `json:"name"`
+	Policy string `json:"policy"`
+}
+
+type internalCapability struct {
+	Name        string               `json:"name"`
+	Permissions []internalPermission `json:"permissions"`
+}
+
+// Define a struct for the capabilities of a session as cached
+type cachedCapabilities struct {
+	capabilities []internalCapability
+	fetched      time.Time
+}
+
+var (
+	capabilitiesCacheMu sync.Mutex
+	capabilitiesCache   = map[string]*cachedCapabilities{}
+)
+
+// Returns the key under which the capabilities of the caller's session are cached, empty if the caller has none
+func capabilitiesCacheKey(server *Server, caller *http.Request) string {
+	if cookie, err := caller.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		return server.Name + "|session|" + cookie.Value
+	}
+	if auth := caller.Header.Get("Authorization"); auth != "" {
+		hash := sha256.Sum256([]byte(auth))
+		return server.Name + "|authorization|" + hex.EncodeToString(hash[:])
+	}
+	return ""
+}
+
+// Retrieve the policy for each of the capabilities, by group, from the }Capabilities cube
+func groupCapabilityPolicies(server *Server, caller *http.Request, groups []string) (map[string]map[string]string, error) {
+	members := []string{}
+	for _, group := range groups {
+		members = append(members, "[}Groups].["+strings.ReplaceAll(group, "]", "]]")+"]")
+	}
+	mdx := "SELECT {" + strings.Join(members, ",") + "} ON COLUMNS, {[}Capabilities].MEMBERS} ON ROWS FROM [}Capabilities]"
+	body, _ := json.Marshal(map[string]string{"MDX": mdx})
+	data, err := requestServerResourceAsCaller(server, caller, "POST", "/ExecuteMDX?$expand=Axes($expand=Tuples($expand=Members($select=Name))),Cells($select=Value)", body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk the cells, the columns being the groups and the rows the capabilities
+	var cellset struct {
+		Axes []struct {
+			Tuples []struct {
+				Members []struct {
+					Name string
+				}
+			}
+		}
+		Cells []struct {
+			Value interface{}
+		}
+	}
+	if err := json.Unmarshal(data, &cellset); err != nil {
+		return nil, err
+	}
+	policies := map[string]map[string]string{}
+	if len(cellset.Axes) < 2 {
+		return policies, nil
+	}
+	columns := cellset.Axes[0].Tuples
+	for row, capability := range cellset.Axes[1].Tuples {
+		if len(capability.Members) == 0 {
+			continue
+		}
+		byGroup := map[string]string{}
+		for column, group := range columns {
+			ordinal := row*len(columns) + column
+			if ordinal >= len(cellset.Cells) || len(group.Members) == 0 {
+				continue
+			}
+			if policy, ok := cellset.Cells[ordinal].Value.(string); ok {
+				byGroup[group.Members[0].Name] = policy
+			}
+		}
+		policies[capability.Members[0].Name] = byGroup
+	}
+	return policies, nil
+}
+
+// Determine the capabilities of the caller based on the security of the database
+func callerCapabilities(server *Server, caller *http.Request) ([]internalCapability, error) {
+	// Retrieve the caller and the groups the caller is a member of
+	data, err := requestServerResourceAsCaller(server, caller, "GET", "/ActiveUser?$select=Name,Type&$expand=Groups($select=Name)", nil)
+	if err != nil {
+		return nil, err
+	}
+	var user struct {
+		Name   string
+		Type   string
+		Groups []struct {
+			Name string
+		}
+	}
+	if err := json.Unmarshal(data, &user); err != nil {
+		return nil, err
+	}
+	isAdmin := strings.EqualFold(user.Type, "Admin")
+	groups := []string{}
+	for _, group := range user.Groups {
+		if strings.EqualFold(group.Name, "ADMIN") {
+			isAdmin = true
+		}
+		groups = append(groups, group.Name)
+	}
+
+	// Administrators can do anything, for anybody else we need the policies assigned to their groups. Users who
+	// can't read the }Capabilities cube simply get the default policies.
+	policies := map[string]map[string]string{}
+	if !isAdmin && len(groups) > 0 {
+		policies, err = groupCapabilityPolicies(server, caller, groups)
+		var upstreamErr *upstreamError
+		if errors.As(err, &upstreamErr) && (upstreamErr.statusCode == http.StatusForbidden || upstreamErr.statusCode == http.StatusNotFound) {
+			logger.Debug("Unable to read capabilities, using default policies", zap.String("server", server.Name), zap.String("user", user.Name), zap.Error(err))
+			policies, err = map[string]map[string]string{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A capability granted to any of the groups is granted, otherwise it is denied if denied to any of the groups
+	capabilities := []internalCapability{}
+	for _, capability := range legacyCapabilities {
+		policy := ""
+		if isAdmin {
+			policy = "Grant"
+		} else {
+			for _, groupPolicy := range policies[capability.element] {
+				if strings.EqualFold(groupPolicy, "GRANT") {
+					policy = "Grant"
+					break
+				} else if strings.EqualFold(groupPolicy, "DENY") {
+					policy = "Deny"
+				}
+			}
+		}
+		capabilities = append(capabilities, internalCapability{Name: capability.name, Permissions: []internalPermission{{Name: "Execute", Policy: policy}}})
+	}
+	return capabilities, nil
+}
+
+func handleInternalCapabilitiesResource(w http.ResponseWriter, r *http.Request, server *Server) {
 
 	// Only allow GET requests
 	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", "GET")
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, "GET")
+		return
+	}
+
+	// Capabilities are determined per session, without one there is nobody to determine the capabilities for
+	key := capabilitiesCacheKey(server, r)
+	if key == "" {
+		writeODataError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "A session is required to determine the capabilities")
 		return
 	}
 
-	// The capabilities list is simply a fixed collection of strings
-	data := `[ { "name" : "RunServerExplorer", "permissions" : [ { "name" : "Execute", "policy" : "" } ] }, { "name" : "UsePersonalWorkspaceWritebackMode", "permissions" : [ { "name" : "Execute", "policy" : "" } ] }, { "name" : "UseSandbox", "permissions" : [ { "name" : "Execute", "policy" : "Grant" } ] }, { "name" : "ManageDataReservation", "permissions" : [ { "name" : "Execute", "policy" : "Grant" } ] }, { "name" : "DataReservationOverride", "permissions" : [ { "name" : "Execute", "policy" : "Grant" } ] }, { "name" : "Consolidation TypeIn Spreading", "permissions" : [ { "name" : "Execute", "policy" : "Grant" } ] }, { "name" : "Allow Spreading", "permissions" : [ { "name" : "Execute", "policy" : "Grant" } ] }, { "name" : "Allow Export as Text", "permissions" : [ { "name" : "Execute", "policy" : "Grant" } ] } ]`
+	// Answer from cache if we determined the capabilities for this session recently
+	ttl := viper.GetDuration("servers.capabilities-cache-ttl")
+	capabilitiesCacheMu.Lock()
+	cached, exists := capabilitiesCache[key]
+	capabilitiesCacheMu.Unlock()
+	if !exists || time.Since(cached.fetched) >= ttl {
+		capabilities, err := callerCapabilities(server, r)
+		if err != nil {
+			logger.Error("Unable to determine capabilities", zap.String("server", server.Name), zap.String("request-id", requestID(r)), zap.Error(err))
+			writeUpstreamError(w, r, err)
+			return
+		}
+		cached = &cachedCapabilities{capabilities: capabilities, fetched: time.Now()}
+
+		// Cache the capabilities, cleaning up the capabilities of sessions that expired while we're at it
+		capabilitiesCacheMu.Lock()
+		for key, entry := range capabilitiesCache {
+			if time.Since(entry.fetched) >= ttl {
+				delete(capabilitiesCache, key)
+			}
+		}
+		capabilitiesCache[key] = cached
+		capabilitiesCacheMu.Unlock()
+	}
 
 	// Write the response
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(data))
+	json.NewEncoder(w).Encode(cached.capabilities)
+}
+
+// Define the structure of the configuration returned by the internal API, in the order the internal API returned it
+type internalConfiguration struct {
+	ServerName                                        string
+	AdminHost                                         string
+	ProductVersion                                    string
+	PortNumber                                        int
+	ClientMessagePortNumber                           int
+	HTTPPortNumber                                    int
+	IntegratedSecurityMode                            int
+	SecurityMode                                      string
+	ClientCAMURI                                      string
+	AllowSeparateNandCRules                           int
+	DistributedOutputDir                              string
+	DisableSandboxing                                 bool
+	JobQueuing                                        bool
+	ForceReevaluationOfFeedersForFedCellsOnDataChange bool
+	DataBaseDirectory                                 string
+	UnicodeUpperLowerCase                             bool
+	IdleConnectionTimeOutSeconds                      int
+}
+
+// Define a struct for the configuration of a database as cached
+type cachedConfiguration struct {
+	configuration internalConfiguration
+	fetched       time.Time
+}
+
+var (
+	configurationCacheMu sync.Mutex
+	configurationCache   = map[string]*cachedConfiguration{}
+)
+
+// Request a resource relative to the service root of the database of a server. Requests for servers we discovered
+// ourselves use the credentials of their TM1 v12 service instance, those for manually registered servers use the
+// credentials of the caller.
+func requestServerResource(server *Server, caller *http.Request, path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", server.upstreamURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	instance := lookupTM1Instance(server.instance)
+	if instance != nil {
+		if err := authorizeTM1Request(req, instance); err != nil {
+			return nil, err
+		}
+	} else {
+		copyCallerCredentials(req, caller)
+	}
+	return sendServerRequest(req, instance)
+}
+
+// Request a resource relative to the service root of the database of a server on behalf of the caller, using the
+// caller's session and sending the request to the replica the session lives on
+func requestServerResourceAsCaller(server *Server, caller *http.Request, method string, path string, body []byte) ([]byte, error) {
+	target := server.upstreamURL
+	if server.balancer != nil {
+		if replicaURL := server.balancer.targetURL(caller); replicaURL != "" {
+			target = replicaURL
+		}
+	}
+	req, err := http.NewRequest(method, target+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	copyCallerCredentials(req, caller)
+	return sendServerRequest(req, nil)
+}
+
+// Copy the credentials, be it a session or an authorization, the caller presented to the request
+func copyCallerCredentials(req *http.Request, caller *http.Request) {
+	for _, header := range []string{"Authorization", "Cookie", viper.GetString("servers.client-auth.identity-header")} {
+		if header == "" {
+			continue
+		}
+		if value := caller.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+}
+
+// Send a request to the database of a server, returning the body if successful
+func sendServerRequest(req *http.Request, instance *tm1Instance) ([]byte, error) {
+	client := newUpstreamClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure we got the resource and not an error
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if resp.StatusCode == http.StatusUnauthorized && instance != nil {
+			tm1RequestUnauthorized(instance)
+		}
+		return nil, newUpstreamError(resp, body)
+	}
+	return body, nil
+}
+
+// Copy the properties of a v12 configuration that match one of ours, skipping any with an unexpected type
+func copyConfigurationProperties(configuration *internalConfiguration, data []byte) error {
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	target := reflect.ValueOf(configuration).Elem()
+	for i := 0; i < target.NumField(); i++ {
+		if value, exists := values[target.Type().Field(i).Name]; exists {
+			json.Unmarshal(value, target.Field(i).Addr().Interface())
+		}
+	}
+	return nil
 }
 
-func handleInternalConfigurationResource(w http.ResponseWriter, r *http.Request) {
+// Find a property anywhere in a, possibly nested, JSON object
+func findConfigurationProperty(data interface{}, name string) (interface{}, bool) {
+	object, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if value, exists := object[name]; exists {
+		return value, true
+	}
+	for _, value := range object {
+		if found, exists := findConfigurationProperty(value, name); exists {
+			return found, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the configuration of the database of a server, from cache if we retrieved it recently
+func databaseConfiguration(server *Server, caller *http.Request) (internalConfiguration, error) {
+	configurationCacheMu.Lock()
+	cached, exists := configurationCache[server.upstreamURL]
+	configurationCacheMu.Unlock()
+	if exists && time.Since(cached.fetched) < viper.GetDuration("servers.configuration-cache-ttl") {
+		return cached.configuration, nil
+	}
+
+	// The static configuration provides most of the properties
+	configuration := internalConfiguration{}
+	data, err := requestServerResource(server, caller, "/Configuration")
+	if err != nil {
+		return configuration, err
+	}
+	if err := copyConfigurationProperties(&configuration, data); err != nil {
+		return configuration, err
+	}
+
+	// The idle connection timeout is only part of the active configuration
+	data, err = requestServerResource(server, caller, "/ActiveConfiguration")
+	if err != nil {
+		return configuration, err
+	}
+	var activeConfiguration interface{}
+	if err := json.Unmarshal(data, &activeConfiguration); err != nil {
+		return configuration, err
+	}
+	if value, exists := findConfigurationProperty(activeConfiguration, "IdleConnectionTimeOutSeconds"); exists {
+		if seconds, ok := value.(float64); ok {
+			configuration.IdleConnectionTimeOutSeconds = int(seconds)
+		}
+	}
+
+	// Cache the configuration, cleaning up any configuration that expired while we're at it
+	configurationCacheMu.Lock()
+	for upstreamURL, cached := range configurationCache {
+		if time.Since(cached.fetched) >= viper.GetDuration("servers.configuration-cache-ttl") {
+			delete(configurationCache, upstreamURL)
+		}
+	}
+	configurationCache[server.upstreamURL] = &cachedConfiguration{configuration: configuration, fetched: time.Now()}
+	configurationCacheMu.Unlock()
+	return configuration, nil
+}
+
+func handleInternalConfigurationResource(w http.ResponseWriter, r *http.Request, server *Server) {
 
 	// Only allow GET requests
 	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", "GET")
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, "GET")
 		return
 	}
 
-	// TODO: Configuration can be deduced from /api/v1/Configuration or from /api/v1/ActiveConfiguration if we desparately want to include the IdleConnectionTimeOutSeconds
-	data := `{ "ServerName" : "Planning Sample", "AdminHost" : "", "ProductVersion" : "12.4.5", "PortNumber" : 0, "ClientMessagePortNumber" : 0, "HTTPPortNumber" : 12555, "IntegratedSecurityMode" : 1, "SecurityMode" : "Basic", "ClientCAMURI" : "", "AllowSeparateNandCRules" : 0, "DistributedOutputDir" : "", "DisableSandboxing" : false, "JobQueuing" : false, "ForceReevaluationOfFeedersForFedCellsOnDataChange" : false, "DataBaseDirectory" : "c:\\users\\037583788\\w\\bin\\tm1\\data\\plansamp", "UnicodeUpperLowerCase" : true, "IdleConnectionTimeOutSeconds" : 0 }`
+	// The configuration is retrieved using the credentials of the service, or answered from a cache shared by all
+	// callers, so only hand it out to callers the database itself accepts
+	if capabilitiesCacheKey(server, r) == "" {
+		writeODataError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Credentials are required to retrieve the configuration")
+		return
+	}
+	if _, err := requestServerResourceAsCaller(server, r, "GET", "/ActiveUser?$select=Name", nil); err != nil {
+		logger.Debug("Caller not allowed to retrieve database configuration", zap.String("server", server.Name), zap.String("request-id", requestID(r)), zap.Error(err))
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	// Build the configuration from the configuration of the database
+	configuration, err := databaseConfiguration(server, r)
+	if err != nil {
+		logger.Error("Unable to retrieve database configuration", zap.String("server", server.Name), zap.String("request-id", requestID(r)), zap.Error(err))
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	// Clients connect to the server as we advertise it, not to the database directly
+	configuration.ServerName = server.Name
+	configuration.HTTPPortNumber = server.HTTPPortNumber
+	if server.productVersion != "" {
+		configuration.ProductVersion = server.productVersion
+	}
 
 	// Write the response
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(data))
+	json.NewEncoder(w).Encode(configuration)
 }
 
-func handleInternalSandboxesResource(w http.ResponseWriter, r *http.Request) {
+// Define the structure of a sandbox as returned by the internal API
+type internalSandbox struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	Loaded bool   `json:"loaded"`
+	Queued bool   `json:"queued"`
+}
+
+func handleInternalSandboxesResource(w http.ResponseWriter, r *http.Request, server *Server) {
 
 	// Only allow GET requests
 	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", "GET")
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, "GET")
+		return
+	}
+
+	// Retrieve the sandboxes of the caller from the database
+	data, err := requestServerResourceAsCaller(server, r, "GET", "/Sandboxes?$select=Name,IsActive,IsLoaded,IsQueued", nil)
+	if err != nil {
+		logger.Error("Unable to retrieve sandboxes", zap.String("server", server.Name), zap.String("request-id", requestID(r)), zap.Error(err))
+		writeUpstreamError(w, r, err)
+		return
+	}
+	var sandboxesResponse struct {
+		Sandboxes []struct {
+			Name     string
+			IsActive bool
+			IsLoaded bool
+			IsQueued bool
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(data, &sandboxesResponse); err != nil {
+		logger.Error("Unable to decode sandboxes", zap.String("server", server.Name), zap.String("request-id", requestID(r)), zap.Error(err))
+		writeODataError(w, r, http.StatusBadGateway, errorCodeUpstreamError, "Invalid sandboxes response: "+err.Error())
 		return
 	}
 
-	// TODO: Build the sandboxes response, for now presume empty collection
-	data := `[]`
+	// Translate the sandboxes into their internal representation
+	sandboxes := []internalSandbox{}
+	for _, sandbox := range sandboxesResponse.Sandboxes {
+		sandboxes = append(sandboxes, internalSandbox{Name: sandbox.Name, Active: sandbox.IsActive, Loaded: sandbox.IsLoaded, Queued: sandbox.IsQueued})
+	}
 
 	// Write the response
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(data))
+	json.NewEncoder(w).Encode(sandboxes)
 }
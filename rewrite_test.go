@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestInternalConfigurationRequiresAcceptedCredentials(t *testing.T) {
+	viper.Set("servers.configuration-cache-ttl", "1m")
+	t.Cleanup(func() { viper.Set("servers.configuration-cache-ttl", nil) })
+
+	// The database only accepts a single user, and only hands the configuration to that user
+	const validAuthorization = "Basic YWRtaW46YXBwbGU="
+	database := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != validAuthorization {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/ActiveUser":
+			w.Write([]byte(`{"Name":"Admin"}`))
+		case "/Configuration":
+			w.Write([]byte(`{"ServerName":"Sales","DataBaseDirectory":"/data/sales"}`))
+		case "/ActiveConfiguration":
+			w.Write([]byte(`{"Administration":{"IdleConnectionTimeOutSeconds":900}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(database.Close)
+	server := &Server{Name: "Sales", HTTPPortNumber: 9601, upstreamURL: database.URL}
+	t.Cleanup(func() {
+		configurationCacheMu.Lock()
+		delete(configurationCache, database.URL)
+		configurationCacheMu.Unlock()
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		statusCode    int
+	}{
+		{"accepted caller fills the cache", validAuthorization, http.StatusOK},
+		{"no credentials", "", http.StatusUnauthorized},
+		{"rejected credentials", "Basic Z3Vlc3Q6cGVhcg==", http.StatusUnauthorized},
+		{"accepted caller from the cache", validAuthorization, http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/internal/v1/Configuration", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handleInternalConfigurationResource(w, req, server)
+		if w.Code != test.statusCode {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.statusCode, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var configuration internalConfiguration
+		if err := json.NewDecoder(w.Body).Decode(&configuration); err != nil {
+			t.Fatalf("%s: unable to decode configuration: %v", test.name, err)
+		}
+		if configuration.DataBaseDirectory != "/data/sales" || configuration.IdleConnectionTimeOutSeconds != 900 {
+			t.Errorf("%s: unexpected configuration %+v", test.name, configuration)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Define the signature of a handler for a route of a server. Handlers either serve the request locally or rewrite it
+// and pass it on to next, which forwards it to the database.
+type serverRouteHandler func(w http.ResponseWriter, r *http.Request, server *Server, next http.Handler)
+
+// Define a route of a server, {version} in the path matches any of the versions of the internal API
+type serverRoute struct {
+	path    string
+	handler serverRouteHandler
+}
+
+// The versions of the internal API our clients use
+var internalAPIVersions = []string{"v1", "v1.1"}
+
+// Returns the routes served, or rewritten, by every server before requests get forwarded to the database
+func defaultServerRoutes() []serverRoute {
+	return []serverRoute{
+		{"/api/internal/{version}/capabilities", serveLocally(handleInternalCapabilitiesResource)},
+		{"/api/internal/{version}/configuration", serveLocally(handleInternalConfigurationResource)},
+		{"/api/internal/{version}/sandboxes", serveLocally(handleInternalSandboxesResource)},
+		{"/api/logout", handleLogout},
+	}
+}
+
+// Adapt a handler serving a resource locally to a route handler
+func serveLocally(handler func(w http.ResponseWriter, r *http.Request, server *Server)) serverRouteHandler {
+	return func(w http.ResponseWriter, r *http.Request, server *Server, next http.Handler) {
+		handler(w, r, server)
+	}
+}
+
+// Convert a logout into a POST request closing the active session
+func handleLogout(w http.ResponseWriter, r *http.Request, server *Server, next http.Handler) {
+	body := `{}`
+	logout := r.Clone(r.Context())
+	logout.Method = http.MethodPost
+	logout.URL.Path = "/api/v1/ActiveSession/tm1.Close"
+	logout.URL.RawPath = ""
+	logout.Header.Set("Content-Type", "application/json")
+	logout.Body = io.NopCloser(bytes.NewBufferString(body))
+	logout.ContentLength = int64(len(body))
+	next.ServeHTTP(w, logout)
+}
+
+// Define a router dispatching the requests for a server to the handler of their route. Requests for the REST API
+// without a route are passed on to next, requests for anything else don't address any resource. Handlers get the
+// server as it is at the time of the request, nil meaning it is gone.
+type serverRouter struct {
+	server func() *Server
+	routes map[string]serverRouteHandler
+	next   http.Handler
+}
+
+func newServerRouter(server func() *Server, routes []serverRoute, next http.Handler) *serverRouter {
+	router := &serverRouter{server: server, routes: map[string]serverRouteHandler{}, next: next}
+	for _, route := range routes {
+		if !strings.Contains(route.path, "{version}") {
+			router.routes[route.path] = route.handler
+			continue
+		}
+		for _, version := range internalAPIVersions {
+			router.routes[strings.Replace(route.path, "{version}", version, 1)] = route.handler
+		}
+	}
+	return router
+}
+
+func (sr *serverRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, exists := sr.routes[r.URL.Path]; exists {
+		server := sr.server()
+		if server == nil {
+			writeResourceNotFound(w, r)
+			return
+		}
+		handler(w, r, server, sr.next)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/v1/") {
+		sr.next.ServeHTTP(w, r)
+		return
+	}
+	writeResourceNotFound(w, r)
+}
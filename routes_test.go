@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Define a struct recording the request passed on to the next handler
+type recordedRequest struct {
+	method string
+	path   string
+	body   string
+	server *Server
+}
+
+// Returns a getter for a server that never changes
+func staticServer(server *Server) func() *Server {
+	return func() *Server { return server }
+}
+
+// Returns a handler recording the request passed on to it
+func recordingHandler(recorded **recordedRequest) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*recorded = &recordedRequest{method: r.Method, path: r.URL.Path, body: string(body)}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func TestServerRouterInternalAPIVersions(t *testing.T) {
+	server := &Server{Name: "Planning Sample"}
+	var handled *recordedRequest
+	routes := []serverRoute{
+		{"/api/internal/{version}/stub", func(w http.ResponseWriter, r *http.Request, s *Server, next http.Handler) {
+			handled = &recordedRequest{method: r.Method, path: r.URL.Path, server: s}
+			w.WriteHeader(http.StatusOK)
+		}},
+	}
+	var forwarded *recordedRequest
+	current := server
+	router := newServerRouter(func() *Server { return current }, routes, recordingHandler(&forwarded))
+
+	for _, version := range []string{"v1", "v1.1"} {
+		handled, forwarded = nil, nil
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/internal/"+version+"/stub", nil))
+		if w.Code != http.StatusOK || handled == nil {
+			t.Fatalf("version %s: expected the route handler to serve the request, got status %d", version, w.Code)
+		}
+		if handled.server != server {
+			t.Errorf("version %s: expected the route handler to get the server of the router", version)
+		}
+		if forwarded != nil {
+			t.Errorf("version %s: expected the request not to be passed on", version)
+		}
+	}
+
+	// Versions we don't know about don't address any resource
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/internal/v2/stub", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown version, got %d", w.Code)
+	}
+
+	// Handlers get the server as it is at the time of the request, as it can change without the proxy restarting
+	current = &Server{Name: "Planning Sample", productVersion: "12.5.1"}
+	handled = nil
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/internal/v1.1/stub", nil))
+	if handled == nil || handled.server != current {
+		t.Errorf("expected the route handler to get the server as it is now")
+	}
+
+	// Servers that are gone have no resources left
+	current = nil
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/internal/v1/stub", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a server that is gone, got %d", w.Code)
+	}
+}
+
+func TestDefaultServerRoutesCoverInternalAPIVersions(t *testing.T) {
+	router := newServerRouter(staticServer(&Server{}), defaultServerRoutes(), http.NotFoundHandler())
+	for _, version := range internalAPIVersions {
+		for _, resource := range []string{"capabilities", "configuration", "sandboxes"} {
+			if _, exists := router.routes["/api/internal/"+version+"/"+resource]; !exists {
+				t.Errorf("expected a route for the %s resource of internal API version %s", resource, version)
+			}
+		}
+	}
+}
+
+func TestServerRouterLogout(t *testing.T) {
+	var forwarded *recordedRequest
+	router := newServerRouter(staticServer(&Server{Name: "Planning Sample"}), defaultServerRoutes(), recordingHandler(&forwarded))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/logout", nil))
+	if forwarded == nil {
+		t.Fatalf("expected the logout to be passed on, got status %d", w.Code)
+	}
+	if forwarded.method != http.MethodPost || forwarded.path != "/api/v1/ActiveSession/tm1.Close" || forwarded.body != "{}" {
+		t.Errorf("expected POST /api/v1/ActiveSession/tm1.Close with body {}, got %s %s with body %q", forwarded.method, forwarded.path, forwarded.body)
+	}
+}
+
+func TestServerRouterPassthroughAndNotFound(t *testing.T) {
+	tests := []struct {
+		method    string
+		path      string
+		forwarded bool
+	}{
+		{http.MethodGet, "/api/v1/Cubes", true},
+		{http.MethodPost, "/api/v1/ExecuteMDX", true},
+		{http.MethodGet, "/api/v1/Cubes('Sales')/Views", true},
+		{http.MethodGet, "/", false},
+		{http.MethodGet, "/api/v1", false},
+		{http.MethodGet, "/api/v2/Cubes", false},
+		{http.MethodGet, "/api/internal/v1/unknown", false},
+		{http.MethodGet, "/index.html", false},
+	}
+	for _, test := range tests {
+		var forwarded *recordedRequest
+		router := newServerRouter(staticServer(&Server{}), defaultServerRoutes(), recordingHandler(&forwarded))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if test.forwarded {
+			if forwarded == nil || forwarded.method != test.method || forwarded.path != test.path {
+				t.Errorf("%s %s: expected the request to be passed on unchanged, got %+v", test.method, test.path, forwarded)
+			}
+			continue
+		}
+		if forwarded != nil || w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected status 404 without passing the request on, got status %d", test.method, test.path, w.Code)
+		}
+	}
+}
@@ -1,159 +1,32 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
-	"encoding/json"
-	"io"
+	"encoding/hex"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
-	"text/template"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
 var (
-	activeServersByName     = map[string]Server{}
-	activeServersByPort     = map[int]string{}
-	dictPortByServer        = map[string]int{}
-	dictServerByPort        = map[int]string{}
-	portLast            int = 0
-
-	mu                  sync.Mutex
-	wg                  sync.WaitGroup
-	serversWatcher      *fsnotify.Watcher
-	ignoreServersUpdate bool = false
-	updatePortMapFile   bool = false
-)
-
-// File in which we persist our server to port map
-const portMapFilePath = "servers.json"
-
-func savePortMapToFile() {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Only update if required
-	if updatePortMapFile {
-		// Convert map to JSON
-		jsonPortMap, err := json.MarshalIndent(dictPortByServer, "", "  ")
-		if err != nil {
-			logger.Error("Error marshalling port map to JSON", zap.Error(err))
-			return
-		}
-
-		// Mark as an internal update
-		ignoreServersUpdate = true
-
-		// Write JSON to file
-		err = os.WriteFile(portMapFilePath, jsonPortMap, 0644)
-		if err != nil {
-			logger.Error("Error writing port map to file", zap.Error(err))
-		}
-
-		// Mark the port map file as updated
-		updatePortMapFile = false
-	}
-}
-
-func updatePortMapFromFile() bool {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Read file content
-	jsonPortMap, err := os.ReadFile(portMapFilePath)
-	if err != nil {
-		logger.Error("Error reading port map from file", zap.Error(err))
-		return false
-	}
-
-	// Parse JSON back to map
-	var portMap map[string]int
-	err = json.Unmarshal(jsonPortMap, &portMap)
-	if err != nil {
-		logger.Error("Error unmarshalling port map JSON", zap.Error(err))
-		return false
-	}
+	activeServersByName = map[string]Server{}
+	activeServersByPort = map[int]string{}
 
-	// Restore map
-	dictPortByServer = make(map[string]int)
-	dictServerByPort = make(map[int]string)
-	for server, port := range portMap {
-		dictPortByServer[server] = port
-		dictServerByPort[port] = server
-	}
-	return true
-}
-
-func watchPortMapFile() {
-	for {
-		select {
-		case event, ok := <-serversWatcher.Events:
-			if !ok {
-				return
-			}
-
-			// Reload the file if it's modified and not an internal write
-			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
-				if ignoreServersUpdate {
-					// Skip internal writes
-					ignoreServersUpdate = false
-					continue
-				}
-
-				// Reload the port map from file
-				if updatePortMapFromFile() {
-					logger.Info("Servers port map reloaded")
-				}
-			}
-		case err, ok := <-serversWatcher.Errors:
-			if !ok {
-				return
-			}
-			logger.Error("Servers file watcher error", zap.Error(err))
-		}
-	}
-}
-
-func initPortMap() {
-	// Check if file exists
-	_, err := os.Stat(portMapFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// It does not, initialize with empty map so we can watch it
-			err = os.WriteFile(portMapFilePath, []byte(`{}`), 0644)
-			if err != nil {
-				logger.Error("Error writing port map to file", zap.Error(err))
-			}
-		}
-	}
-
-	// Initialize the port map from file
-	updatePortMapFromFile()
-
-	// Set up a watcher for the servers file
-	serversWatcher, err = fsnotify.NewWatcher()
-	if err != nil {
-		logger.Error("Failed to initialzing servers file watcher", zap.Error(err))
-		return
-	}
-	if err = serversWatcher.Add(portMapFilePath); err != nil {
-		logger.Error("Failed to start watching the servers file", zap.Error((err)))
-	}
-
-	// Start watching the servers file
-	go watchPortMapFile()
-}
+	mu sync.Mutex
+	wg sync.WaitGroup
+)
 
 func isPortAvailable(port int) bool {
 	// Check if the specified port is available by trying to listen on it
@@ -168,69 +41,79 @@ func isPortAvailable(port int) bool {
 }
 
 func assignPort(server string) int {
-	portMin := viper.GetInt("servers.port-range.min")
-	portMax := viper.GetInt("servers.port-range.max")
+	// A server with a port pinned to it only ever gets that port, unless we are allowed to serve it on another port
+	// for as long as the pinned port is not available
+	if port, pinned := pinnedPortLocked(server); pinned {
+		if _, used := activeServersByPort[port]; !used && isPortAvailable(port) {
+			assignPortMapEntryLocked(server, port)
+			return port
+		}
+		if viper.GetBool("servers.strict-ports") {
+			logger.Warn("Port pinned to server not available, server not accepting clients until it is", zap.String("server", server), zap.Int("port", port))
+			return 0
+		}
+		logger.Warn("Port pinned to server not available, using another port until it is", zap.String("server", server), zap.Int("port", port))
+
+		// The other port is not recorded in the port map, the server remains pinned to its port
+		return findFreePortLocked(server)
+	}
 
 	// Check if this server has had a port assigned to it that is:
 	// - not currently being used
-	// - and still in bounds of the port range
-	if port, exists := dictPortByServer[server]; exists {
-		if _, exists := activeServersByPort[port]; !exists {
-			if isPortAvailable(port) {
-				// Reuse this port
-				return port
-			} else {
-				// Port is not available
-				if name, exists := dictServerByPort[port]; exists && name == server {
-					delete(dictServerByPort, port)
-				}
-				delete(dictPortByServer, server)
-				updatePortMapFile = true
-			}
+	// - and still one of the ports we assign
+	if entry, exists := portMapEntries[server]; exists {
+		if _, used := activeServersByPort[entry.Port]; !used && isAssignablePort(entry.Port) && isPortAvailable(entry.Port) {
+			// Reuse this port
+			assignPortMapEntryLocked(server, entry.Port)
+			return entry.Port
 		}
+
+		// Port is not available
+		removePortMapEntryLocked(server)
 	}
 
+	port := findFreePortLocked(server)
+	if port != 0 {
+		assignPortMapEntryLocked(server, port)
+	}
+	return port
+}
+
+// Find a port for a server in the port ranges, returns 0 if there is none left. Callers need to hold mu.
+func findFreePortLocked(server string) int {
 	// Bounds check the last assigned port as configuration might have changed
-	if portLast < portMin || portLast > portMax {
-		portLast = portMin - 1
-		for _, port := range dictPortByServer {
-			if port > portLast {
-				if port > portMax {
-					portLast = portMax
-					break
-				} else {
-					portLast = port
-				}
+	ports := assignablePorts()
+	if len(ports) == 0 {
+		return 0
+	}
+	if portLast < ports[0] || portLast > ports[len(ports)-1] {
+		portLast = ports[0] - 1
+		for _, entry := range portMapEntries {
+			if entry.Port > portLast && isAssignablePort(entry.Port) {
+				portLast = entry.Port
 			}
 		}
 	}
 
-	// Room left in the port range?
-	for portLast++; portLast <= portMax; portLast++ {
-		if isPortAvailable(portLast) {
-			dictPortByServer[server] = portLast
-			dictServerByPort[portLast] = server
-			updatePortMapFile = true
-			return portLast
+	// Room left in the port ranges?
+	for _, port := range ports {
+		if port <= portLast {
+			continue
+		}
+		portLast = port
+		if _, assigned := dictServerByPort[port]; !assigned && !isPortPinnedToOtherLocked(port, server) && isPortAvailable(port) {
+			return port
 		}
 	}
 
-	// Must reuse the first port in the range that's not used and available
-	for port := portMin; port <= portMax; port++ {
-		if _, exists := activeServersByPort[port]; !exists {
-			if isPortAvailable(port) {
-				if name, exists := dictServerByPort[port]; exists {
-					delete(dictPortByServer, name)
-				}
-				dictPortByServer[server] = port
-				dictServerByPort[port] = server
-				updatePortMapFile = true
-				return port
-			}
+	// Must reuse the first port in the port ranges that's not used, not pinned to another server and available
+	for _, port := range ports {
+		if _, used := activeServersByPort[port]; !used && !isPortPinnedToOtherLocked(port, server) && isPortAvailable(port) {
+			return port
 		}
 	}
 
-	// No unused ports left in the port-range
+	// No unused ports left in the port ranges
 	return 0
 }
 
@@ -254,20 +137,53 @@ func (rr *responseRecorder) Write(b []byte) (int, error) {
 	return size, err
 }
 
-func logRequestResponse(next http.Handler) http.Handler {
+// Unwrap returns the wrapped http.ResponseWriter, so the response can be flushed using an http.ResponseController
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// Header carrying the ID of a request, so errors returned to the client can be correlated with the log
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// Returns the ID assigned to the request, if any
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Assign an ID to the request, reusing the ID provided by the client if it looks sensible
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 128 || strings.ContainsFunc(id, func(c rune) bool { return c < 0x21 || c > 0x7e }) {
+		var b [8]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+func logRequestResponse(listener string, server string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Log request details
 		startTime := time.Now()
+		r = withRequestID(w, r)
 
 		// Wrap the response writer to capture the status code and response body size
 		wrappedWriter := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
 
-		// Call the next handler, which could be another middleware or the final handler
-		next.ServeHTTP(wrappedWriter, r)
+		// Call the next handler, which could be another middleware or the final handler, unless we are shutting down
+		trackInFlight(listener, wrappedWriter, r, next)
+
+		// Record the metrics for this request
+		observeRequest(listener, server, r, wrappedWriter.statusCode, wrappedWriter.responseSize, time.Since(startTime))
 
 		// Log response details
 		if logger.Level() == zap.DebugLevel {
 			logger.Debug("Request Details",
+				zap.String("RequestID", requestID(r)),
 				zap.String("Method", r.Method),
 				zap.String("URL", r.URL.Path),
 				zap.Any("Query", r.URL.Query()),
@@ -278,101 +194,18 @@ func logRequestResponse(next http.Handler) http.Handler {
 	})
 }
 
-func startPAReverseProxy() {
-	// Parse the specified PA URL we are proxying here - TODO: IF WE KEEP THIS MAKE THIS DYNAMIC!
-	target := "http://wsl-rhel"
-	targetURL, err := url.Parse(target)
-	if err != nil {
-		logger.Error("Unable to start PA proxy, invalid URL", zap.Error(err), zap.String("url", target))
-		return
-	}
-
-	// Create a new reverse proxy targeting the targetURL
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-
-	// Define a custom error handler to log requests targeting the API that weren't handled
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		logger.Error("Error processing PA endpoint", zap.String("path", r.URL.Path), zap.Error(err))
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-	}
-
-	// Now that we have initiated a reverse proxy handler for this database, start listening to the port associated to it
-	// TODO: IF WE KEEP THIS MAKE THE PORT DYNAMIC AS WELL
-	proxyPortNumber := 5555
-	httpServer := &http.Server{
-		Addr:      ":" + strconv.Itoa(proxyPortNumber),
-		Handler:   logRequestResponse(proxy),
-		TLSConfig: &tls.Config{},
-	}
-
-	logger.Info("Starting PA proxy", zap.Int("port", proxyPortNumber), zap.String("redirect-url", target))
-
-	// Increment the WaitGroup before starting the server goroutine
-	go func() {
-		/*
-			// Using SSL?
-			if server.UsingSSL {
-				if err := server.httpServer.ListenAndServeTLS(viper.GetString("servers.cert-file"), viper.GetString("servers.key-file")); err != http.ErrServerClosed {
-					logger.Error("Proxy, using SSL, failed to start", zap.Error(err), zap.String("server", server.Name), zap.Int("port", server.HTTPPortNumber), zap.String("servers.cert-file", viper.GetString("servers.cert-file")), zap.String("servers.key-file", viper.GetString("servers.key-file")))
-				}
-			} else {
-		*/
-		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-			logger.Error("PA proxy failed to start", zap.Error(err), zap.Int("port", proxyPortNumber))
-		}
-		/*
-			}
-		*/
-	}()
-}
-
-func startReverseProxy(server *Server) {
-	// Map with the variables used to execute the template
-	data := map[string]interface{}{
-		"database": server.Name,
-	}
-
-	// Parse the template
-	databaseUrlTemplate, err := template.New("datbaseUrl").Parse(viper.GetString("tm1-v12.database-url-template$"))
-	if err != nil {
-		logger.Error("Unable to start proxy, database URL template parsing failed", zap.Error(err), zap.String("tm1-v12.database-url-template", viper.GetString("tm1-v12.database-url-template")))
-		return
-	}
-
-	// Execute the template with the data
-	var target bytes.Buffer
-	err = databaseUrlTemplate.Execute(&target, data)
-	if err != nil {
-		logger.Error("Unable to start proxy, failed to execute database URL template", zap.Error(err), zap.String("tm1-v12.database-url-template", viper.GetString("tm1-v12.database-url-template")))
-		return
-	}
-	targetURL, err := url.Parse(target.String())
-	if err != nil {
-		logger.Error("Unable to start proxy, database URL template rendered an invalid URL", zap.Error(err), zap.String("tm1-v12.database-url-template", viper.GetString("tm1-v12.database-url-template")))
-		return
-	}
-
-	// Create a new reverse proxy targeting the targetURL
+// Create a reverse proxy forwarding requests for a server to the service root of the database
+func newServerReverseProxy(server string, targetURL *url.URL) *httputil.ReverseProxy {
+	// Create a new reverse proxy targeting the targetURL, sharing the transport used for all requests to TM1 v12
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.Transport = upstreamTransport
 
 	// Modify the request before it is forwarded
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
-		// Rewrite the paths wer are willing to handle before calling the original director
-		if strings.HasPrefix(req.URL.Path, "/api/v1/") {
-			// The proxy targets the service root of the database, make the path relative to that
-			req.URL.Path = req.URL.Path[7:]
-		} else if req.URL.Path == "/api/logout" {
-			// Convert to POST request targetting /ActiveSession/tm1.Close instead
-			req.Method = "POST"
-			req.URL.Path = "/ActiveSession/tm1.Close"
-			req.Header.Set("Content-Type", "application/json")
-			newBody := `{}`
-			req.Body = io.NopCloser(bytes.NewBufferString(newBody))
-			req.ContentLength = int64(len(newBody))
-		} else {
-			return
-		}
+		// The proxy targets the service root of the database, make the path relative to that
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/api/v1")
+		req.URL.RawPath = ""
 
 		// Call the original director to have the request URL rewritten
 		originalDirector(req)
@@ -384,45 +217,60 @@ func startReverseProxy(server *Server) {
 
 	}
 
-	// Define a custom error handler to log requests targeting the API that weren't handled
+	// Define a custom error handler to log requests that could not be forwarded
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		upstreamErrorsTotal.WithLabelValues(listenerServer, server).Inc()
+		logger.Error("Error forwarding request", zap.String("server", server), zap.String("path", r.URL.Path), zap.String("request-id", requestID(r)), zap.Error(err))
+		writeODataError(w, r, http.StatusBadGateway, errorCodeUpstreamUnavailable, "Unable to forward the request to server '"+server+"'")
+	}
 
-		// For optimal performance of the proxy we'll deal with request targetting our old
-		// internal API (which should have been removed a decade ago already) here instead.
-		if strings.HasPrefix(r.URL.Path, "/api/internal/") {
-			segments := strings.Split(r.URL.Path[14:], "/")
-			if len(segments) == 2 && (segments[0] == "v1.1" || segments[0] == "v1") {
-				switch segments[1] {
-				case "capabilities":
-					handleInternalCapabilitiesResource(w, r)
-					return
-				case "configuration":
-					handleInternalConfigurationResource(w, r)
-					return
-				case "sandboxes":
-					handleInternalSandboxesResource(w, r)
-					return
-				}
-			}
+	return proxy
+}
+
+func startReverseProxy(server *Server) {
+	// Parse the URL of the service root of the server we are proxying
+	target := server.upstreamURL
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		logger.Error("Unable to start proxy, upstream URL invalid", zap.Error(err), zap.String("server", server.Name), zap.String("url", target))
+		return
+	}
+
+	// Requests are spread across the replicas of the database, if known, falling back to the service root of the database
+	if server.balancer == nil {
+		server.balancer = newReplicaBalancer(server.Name)
+	}
+	server.balancer.setFallback(newServerReverseProxy(server.Name, targetURL))
+
+	// Serve the certificate through the reloader so renewed certificates get picked up without restarting the proxy
+	tlsConfig := &tls.Config{}
+	if server.UsingSSL {
+		tlsConfig, err = newReloadingTLSConfig(viper.GetString("servers.cert-file"), viper.GetString("servers.key-file"))
+		if err != nil {
+			logger.Error("Unable to start proxy, using SSL, certificate invalid", zap.Error(err), zap.String("server", server.Name), zap.String("servers.cert-file", viper.GetString("servers.cert-file")), zap.String("servers.key-file", viper.GetString("servers.key-file")))
+			return
 		}
 
-		// Log errors for requests targetting our REST APIs
-		if strings.HasPrefix(r.URL.Path, "/api/") {
-			logger.Error("Error processing API endpoint", zap.String("path", r.URL.Path), zap.Error(err))
-			http.Error(w, "Bad Request", http.StatusBadRequest)
-		} else {
-			http.NotFound(w, r)
+		// Verify client certificates, if configured
+		if err := configureClientAuth(tlsConfig); err != nil {
+			logger.Error("Unable to start proxy, client certificate authentication settings invalid", zap.Error(err), zap.String("server", server.Name), zap.String("servers.client-auth.ca-file", viper.GetString("servers.client-auth.ca-file")), zap.String("servers.client-auth.crl-file", viper.GetString("servers.client-auth.crl-file")))
+			return
 		}
 	}
 
+	// The routes served locally look up the server as it is at the time of the request, as not every change to it
+	// restarts the proxy
+	name := server.Name
+
 	// Now that we have initiated a reverse proxy handler for this database, start listening to the port associated to it
 	server.httpServer = &http.Server{
-		Addr:      ":" + strconv.Itoa(server.HTTPPortNumber),
-		Handler:   logRequestResponse(proxy),
-		TLSConfig: &tls.Config{},
+		Addr:        ":" + strconv.Itoa(server.HTTPPortNumber),
+		Handler:     logRequestResponse(listenerServer, server.Name, withClientIdentity(newServerRouter(func() *Server { return lookupServer(name, false) }, defaultServerRoutes(), server.balancer))),
+		TLSConfig:   tlsConfig,
+		BaseContext: serverBaseContext,
 	}
 
-	logger.Info("Starting server proxy", zap.String("server", server.Name), zap.Int("port", server.HTTPPortNumber), zap.String("redirect-url", target.String()))
+	logger.Info("Starting server proxy", zap.String("server", server.Name), zap.Int("port", server.HTTPPortNumber), zap.String("redirect-url", target))
 
 	// Increment the WaitGroup before starting the server goroutine
 	wg.Add(1)
@@ -431,8 +279,8 @@ func startReverseProxy(server *Server) {
 
 		// Using SSL?
 		if server.UsingSSL {
-			if err := server.httpServer.ListenAndServeTLS(viper.GetString("servers.cert-file"), viper.GetString("servers.key-file")); err != http.ErrServerClosed {
-				logger.Error("Proxy, using SSL, failed to start", zap.Error(err), zap.String("server", server.Name), zap.Int("port", server.HTTPPortNumber), zap.String("servers.cert-file", viper.GetString("servers.cert-file")), zap.String("servers.key-file", viper.GetString("servers.key-file")))
+			if err := server.httpServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				logger.Error("Proxy, using SSL, failed to start", zap.Error(err), zap.String("server", server.Name), zap.Int("port", server.HTTPPortNumber))
 			}
 		} else {
 			if err := server.httpServer.ListenAndServe(); err != http.ErrServerClosed {
@@ -442,7 +290,7 @@ func startReverseProxy(server *Server) {
 	}()
 }
 
-func upsertServer(database *Database) {
+func upsertServer(instance *tm1Instance, database *Database) {
 	acceptsClients := func() bool {
 		for _, replica := range database.ActiveReplicas {
 			if replica.State == "ready" {
@@ -452,37 +300,71 @@ func upsertServer(database *Database) {
 		return false
 	}()
 
+	// Determine the URL of the service root of the database
+	upstreamURL, err := instance.databaseServiceRootURL(database.Name)
+	if err != nil {
+		logger.Error("Unable to render database URL template", zap.Error(err), zap.String("instance", instance.Name), zap.String("database", database.Name))
+		return
+	}
+
 	// Check if we have a server representing this database already
-	server, exists := activeServersByName[database.Name]
+	name := instance.serverName(database.Name)
+	server, exists := activeServersByName[name]
 	if !exists {
 		server = NewServer()
-		server.Name = database.Name
+		server.Name = name
+		server.SelfRegistered = true
+		server.instance = instance.Name
+		server.database = database.Name
+		server.upstreamURL = upstreamURL
+		server.productVersion = database.ProductVersion.SemVer
 		server.Host = viper.GetString("servers.host-name")
 		server.IPAddress = NullableString(viper.GetString("servers.ip-v4-address$"))
 		server.IPv6Address = NullableString(viper.GetString("servers.ip-v6-address$"))
-		server.HTTPPortNumber = assignPort(database.Name)
+		server.HTTPPortNumber = assignPort(name)
 		server.UsingSSL = viper.GetBool("servers.using-ssl")
+		setServerSSLProperties(&server)
 		server.AcceptingClients = server.HTTPPortNumber != 0 && acceptsClients
 		if server.HTTPPortNumber != 0 {
 			startReverseProxy(&server)
-		} else {
-			logger.Error("No more ports available. Please consider increasing the range of available ports!", zap.String("server", database.Name))
+			server.balancer.update(instance, database)
+		} else if _, pinned := pinnedPortLocked(name); !pinned {
+			logger.Error("No more ports available. Please consider increasing the range of available ports!", zap.String("server", name))
 		}
 	} else {
 		updated := false
 
+		// Restart the proxy if the URL of the service root of the database changed
+		if server.HTTPPortNumber != 0 && server.upstreamURL != upstreamURL {
+			stopServer(name)
+			server.upstreamURL = upstreamURL
+			startReverseProxy(&server)
+			updated = true
+		}
+		server.upstreamURL = upstreamURL
+
 		// Check if we are serving this database already
 		if server.HTTPPortNumber == 0 {
 			// We are not, check if we have any port available now
-			server.HTTPPortNumber = assignPort(database.Name)
+			server.HTTPPortNumber = assignPort(name)
 			if server.HTTPPortNumber != 0 {
 				server.AcceptingClients = acceptsClients
 				startReverseProxy(&server)
-				logger.Info("A port has become available. Assigning port to server.", zap.String("server", database.Name), zap.Int("port", server.HTTPPortNumber))
+				logger.Info("A port has become available. Assigning port to server.", zap.String("server", name), zap.Int("port", server.HTTPPortNumber))
 				updated = true
 			}
 		}
-		if !updated && server.AcceptingClients != acceptsClients {
+		// Move the server to the port pinned to it, if it is not being served on that port and it is available now
+		if port, pinned := pinnedPortLocked(name); pinned && server.HTTPPortNumber != 0 && server.HTTPPortNumber != port {
+			if _, used := activeServersByPort[port]; !used && isPortAvailable(port) {
+				logger.Info("Port pinned to server has become available. Moving server to its port.", zap.String("server", name), zap.Int("port", port))
+				stopServer(name)
+				server.HTTPPortNumber = assignPort(name)
+				startReverseProxy(&server)
+				updated = true
+			}
+		}
+		if server.HTTPPortNumber != 0 && server.AcceptingClients != acceptsClients {
 			server.AcceptingClients = !server.AcceptingClients
 			updated = true
 		}
@@ -498,6 +380,18 @@ func upsertServer(database *Database) {
 			server.IPv6Address = NullableString(viper.GetString("servers.ip-v6-address$"))
 			updated = true
 		}
+		if server.productVersion != database.ProductVersion.SemVer {
+			server.productVersion = database.ProductVersion.SemVer
+			updated = true
+		}
+		if setServerSSLProperties(&server) {
+			updated = true
+		}
+
+		// Keep the replicas in rotation up to date, this never requires the proxy to be restarted
+		if server.balancer != nil {
+			server.balancer.update(instance, database)
+		}
 		if !updated {
 			return
 		}
@@ -505,9 +399,22 @@ func upsertServer(database *Database) {
 	server.LastUpdated = time.Now().Format(time.RFC3339)
 	activeServersByName[server.Name] = server
 	activeServersByPort[server.HTTPPortNumber] = server.Name
+	recordServerChangeLocked(server.Name)
 }
 
+// Remove a server, letting anyone tracking the servers know it is gone. Callers need to hold mu.
 func removeServer(name string) {
+	if _, exists := activeServersByName[name]; !exists {
+		return
+	}
+	stopServer(name)
+	recordServerChangeLocked(name)
+}
+
+// Stop the proxy of a server and forget about it, without recording the change as the server is either being
+// restarted or removed. Callers need to hold mu, which is held throughout, as the requests in flight are drained in
+// the background once the proxy stopped accepting new ones.
+func stopServer(name string) {
 	// Lookup the server and remove it from the list
 	server, exists := activeServersByName[name]
 	if !exists {
@@ -516,41 +423,92 @@ func removeServer(name string) {
 
 	logger.Info("Terminating server proxy", zap.String("server", server.Name), zap.Int("port", server.HTTPPortNumber))
 
-	// Shut down the server gracefully
-	if err := server.httpServer.Shutdown(context.Background()); err != nil {
-		logger.Error("Error shutting down server", zap.Error(err), zap.String("server", server.Name), zap.Int("port", server.HTTPPortNumber))
-	}
-
-	// Remove the server from the map of active servers
+	// Remove the server from the maps of active servers, its port can be reused as soon as the proxy stopped listening
 	delete(activeServersByPort, server.HTTPPortNumber)
 	delete(activeServersByName, server.Name)
+	forgetServerMetrics(server.Name)
+
+	// Shut down the proxy gracefully, giving requests in flight until the drain timeout to finish
+	drainHTTPServer(server.httpServer, func(err error) {
+		logger.Error("Error shutting down server", zap.Error(err), zap.String("server", server.Name), zap.Int("port", server.HTTPPortNumber))
+	})
 }
 
-// Refresh our collection of servers based on the available databases
+// Refresh our collection of servers based on the available databases of all TM1 v12 service instances
 func refreshServers() error {
-	// Retrieve the list of databases from the tm1 service
-	databases, err := listDatabases()
-	if err != nil {
-		return err
+	// Retrieve the list of databases from every tm1 service instance
+	instances := tm1Instances()
+	databasesByInstance := map[string][]Database{}
+	var errs []error
+	for i := range instances {
+		startTime := time.Now()
+		databases, err := listDatabases(&instances[i])
+		observeListDatabases(instances[i].Name, err, time.Since(startTime))
+		if err != nil {
+			// Leave the servers of this instance as they are until we can reach it again
+			logger.Error("Unable to list databases", zap.String("instance", instances[i].Name), zap.Error(err))
+			errs = append(errs, err)
+			continue
+		}
+		databasesByInstance[instances[i].Name] = databases
+	}
+	if len(instances) > 0 && len(errs) == len(instances) {
+		return errors.Join(errs...)
 	}
 
 	mu.Lock()         // Lock before starting the refresh
 	defer mu.Unlock() // Unlock after we've completed the refresh
 
+	// Determine which server represents which database, the first database advertised under a server name wins
+	type instanceDatabase struct {
+		instance *tm1Instance
+		database *Database
+	}
+	wanted := map[string]instanceDatabase{}
+	advertised := map[string]string{} // Server names advertised so far, keyed by their lower case form
+	for i := range instances {
+		databases, ok := databasesByInstance[instances[i].Name]
+		if !ok {
+			continue
+		}
+		for j := range databases {
+			if !instances[i].advertises(&databases[j]) {
+				continue
+			}
+			// An alias can collide with the name another database is advertised under, which we only get to see here
+			name := instances[i].serverName(databases[j].Name)
+			if otherName, exists := advertised[strings.ToLower(name)]; exists {
+				other := wanted[otherName]
+				if other.instance.Name == instances[i].Name {
+					logger.Warn("Database not advertised, another database of the same instance is advertised under the same name. Please check the aliases of this instance!", zap.String("server", name), zap.String("instance", instances[i].Name), zap.String("database", databases[j].Name), zap.String("other-database", other.database.Name))
+				} else {
+					logger.Warn("Database not advertised, another instance advertises a server with the same name. Please consider using a name prefix or suffix for these instances!", zap.String("server", name), zap.String("instance", instances[i].Name), zap.String("other-instance", other.instance.Name))
+				}
+				continue
+			}
+			// A manually registered server takes precedence over a database with the same name
+			if _, registered := registeredServers[name]; registered {
+				logger.Debug("Database not advertised, a server with the same name has been registered manually", zap.String("server", name), zap.String("instance", instances[i].Name))
+				continue
+			}
+			wanted[name] = instanceDatabase{instance: &instances[i], database: &databases[j]}
+			advertised[strings.ToLower(name)] = name
+		}
+	}
+
 	// Update the servers based on the current list of databases, starting
 	// by removing any servers representing a database that no longer exists
 	var serversToRemove []string
 	for _, server := range activeServersByName {
-		exists := func() bool {
-			for _, database := range databases {
-				if server.Name == database.Name && database.Replicas > 0 {
-					return true
-				}
-			}
-			return false
-		}()
-
-		if !exists {
+		// Servers registered manually aren't backed by a database
+		if !server.SelfRegistered {
+			continue
+		}
+		// Keep the servers of instances we couldn't reach, unless the instance is no longer configured
+		if _, listed := databasesByInstance[server.instance]; !listed && slices.ContainsFunc(instances, func(instance tm1Instance) bool { return instance.Name == server.instance }) {
+			continue
+		}
+		if target, exists := wanted[server.Name]; !exists || target.instance.Name != server.instance || target.database.Name != server.database {
 			serversToRemove = append(serversToRemove, server.Name)
 		}
 	}
@@ -559,12 +517,14 @@ func refreshServers() error {
 	}
 
 	// Now lets make sure that every database is represented by a server
-	for _, database := range databases {
-		if database.Replicas > 0 {
-			upsertServer(&database)
-		}
+	for name, target := range wanted {
+		upsertServer(target.instance, target.database)
+		touchPortMapEntryLocked(name)
 	}
 
+	// Release the ports of servers we haven't seen in a long time
+	collectPortMapGarbageLocked()
+
 	// Make sure any changes made to the port map get persisted in the servers file
 	go func() {
 		savePortMapToFile()
@@ -572,12 +532,9 @@ func refreshServers() error {
 	return nil
 }
 
-func listServers() []Server {
-	// Before we return the list of servers refresh it first
-	err := refreshServers()
-	if err != nil {
-		logger.Error("Unable to refresh servers list", zap.Error(err))
-	}
+func listServers(forceRefresh bool) []Server {
+	// Answer from the servers as last polled unless explicitly asked to refresh them first
+	ensureServersRefreshed(forceRefresh)
 
 	mu.Lock()
 	defer mu.Unlock()
@@ -590,12 +547,9 @@ func listServers() []Server {
 	return servers
 }
 
-func lookupServer(name string) *Server {
-	// Before we look up the requested server refresh the list of servers
-	err := refreshServers()
-	if err != nil {
-		logger.Error("Unable to refresh servers list", zap.Error(err))
-	}
+func lookupServer(name string, forceRefresh bool) *Server {
+	// Answer from the servers as last polled unless explicitly asked to refresh them first
+	ensureServersRefreshed(forceRefresh)
 
 	mu.Lock()
 	defer mu.Unlock()
@@ -608,13 +562,19 @@ func lookupServer(name string) *Server {
 	return &server
 }
 
-func shutdownAllServers() {
+func shutdownAllServers(ctx context.Context) {
+	// Stop polling first so no new proxies get started while we are shutting down
+	stopServersPoller()
+
+	// Shut down the PA proxy, if running
+	stopPAReverseProxy(ctx)
+
 	mu.Lock()
 	defer mu.Unlock()
 
 	// Shut down all active servers gracefully
 	for _, server := range activeServersByName {
-		if err := server.httpServer.Shutdown(context.Background()); err != nil {
+		if err := shutdownHTTPServer(ctx, server.httpServer); err != nil {
 			logger.Error("Error shutting down server", zap.Error(err), zap.String("server", server.Name), zap.Int("port", server.HTTPPortNumber))
 		}
 	}
@@ -0,0 +1,241 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/sys/unix"
+)
+
+// Determine if the service is being started by systemd, in which case it sets the invocation ID and, for services
+// of Type=notify, the socket to notify it on
+func isPlatformService() (bool, error) {
+	return os.Getenv("INVOCATION_ID") != "" || os.Getenv("NOTIFY_SOCKET") != "", nil
+}
+
+// Services run by systemd get their working directory from the unit file
+func prepareServiceEnvironment(configFile string) {}
+
+// Map the log level onto the syslog priority prefix the journal understands
+func encodeJournalLevel(level zapcore.Level, enc zapcore.PrimitiveArrayEncoder) {
+	priority := "<6>"
+	switch level {
+	case zapcore.DebugLevel:
+		priority = "<7>"
+	case zapcore.WarnLevel:
+		priority = "<4>"
+	case zapcore.ErrorLevel:
+		priority = "<3>"
+	case zapcore.DPanicLevel, zapcore.PanicLevel:
+		priority = "<2>"
+	case zapcore.FatalLevel:
+		priority = "<2>"
+	}
+	enc.AppendString(priority + level.CapitalString())
+}
+
+// Services run by systemd log to the log file as well as to stderr, which ends up in the journal. The journal
+// timestamps entries itself and picks up the priority from the prefix of every line.
+func newServiceLogger(fileCore zapcore.Core) *zap.Logger {
+	journalEncoderConfig := zap.NewProductionEncoderConfig()
+	journalEncoderConfig.TimeKey = ""
+	journalEncoderConfig.EncodeLevel = encodeJournalLevel
+	journalCore := zapcore.NewCore(zapcore.NewConsoleEncoder(journalEncoderConfig), zapcore.AddSync(os.Stderr), loggerLevel)
+	return zap.New(zapcore.NewTee(fileCore, journalCore))
+}
+
+func runPlatformService(ctx context.Context, name string) {
+	logger.Info("Starting " + name + " systemd service")
+
+	// Keep the watchdog happy, if systemd expects us to
+	startWatchdog()
+
+	// Run the service, which notifies systemd once it is ready, until we get signalled to stop
+	runServer(ctx)
+}
+
+// Send a notification to systemd, if it is listening
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	// Sockets in the abstract namespace are indicated by a leading '@'
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		logger.Error("Unable to notify systemd", zap.Error(err), zap.String("state", state))
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logger.Error("Unable to notify systemd", zap.Error(err), zap.String("state", state))
+	}
+}
+
+func notifyReady() {
+	sdNotify("READY=1\nSTATUS=Serving servers")
+}
+
+func notifyStopping() {
+	sdNotify("STOPPING=1")
+}
+
+// Ping the watchdog at half the interval systemd expects, if the watchdog is enabled for this process
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	logger.Info("Watchdog enabled", zap.Duration("interval", interval))
+	go func() {
+		for range time.Tick(interval) {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
+
+var (
+	activatedListenersOnce sync.Once
+	activatedListenersMap  map[int]net.Listener
+)
+
+// Returns the listeners systemd passed us through socket activation, by port
+func activatedListeners() map[int]net.Listener {
+	activatedListenersOnce.Do(func() {
+		activatedListenersMap = map[int]net.Listener{}
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			return
+		}
+
+		// Make sure any processes we start don't pick up the sockets meant for us
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		// Passed file descriptors start at 3, right after stdin, stdout and stderr
+		for fd := 3; fd < 3+count; fd++ {
+			syscall.CloseOnExec(fd)
+			file := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+			listener, err := net.FileListener(file)
+			file.Close()
+			if err != nil {
+				logger.Error("Unable to use socket passed by systemd", zap.Error(err), zap.Int("fd", fd))
+				continue
+			}
+			addr, ok := listener.Addr().(*net.TCPAddr)
+			if !ok {
+				logger.Error("Unable to use socket passed by systemd, not a TCP socket", zap.Int("fd", fd), zap.String("address", listener.Addr().String()))
+				listener.Close()
+				continue
+			}
+			activatedListenersMap[addr.Port] = listener
+		}
+	})
+	return activatedListenersMap
+}
+
+// Reload the configuration on SIGHUP, as is customary for daemons
+func setupPlatformSignalHandling() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if logger == nil {
+				continue
+			}
+			logger.Info("Reload signal received, reloading configuration...")
+			sdNotify("RELOADING=1\nMONOTONIC_USEC=" + strconv.FormatInt(monotonicUsec(), 10))
+			reloadConfig()
+			notifyReady()
+		}
+	}()
+}
+
+// Returns the current CLOCK_MONOTONIC time, as required when notifying systemd about a reload
+func monotonicUsec() int64 {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return ts.Nano() / 1000
+}
+
+// Directory in which we install the systemd unit file
+const systemdUnitDir = "/etc/systemd/system"
+
+// Install a systemd unit for the admin host and enable it
+func installService(name string, executable string, configFile string) error {
+	unit := `[Unit]
+Description=TM1 v12 admin host
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+WorkingDirectory=` + filepath.Dir(configFile) + `
+ExecStart=` + strconv.Quote(executable) + ` serve --config ` + strconv.Quote(configFile) + `
+ExecReload=/bin/kill -HUP $MAINPID
+WatchdogSec=30
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`
+	unitFile := filepath.Join(systemdUnitDir, name+".service")
+	if _, err := os.Stat(unitFile); err == nil {
+		return errors.New("unit file " + unitFile + " exists already")
+	}
+	if err := os.WriteFile(unitFile, []byte(unit), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", name+".service")
+}
+
+func uninstallService(name string) error {
+	unitFile := filepath.Join(systemdUnitDir, name+".service")
+	if _, err := os.Stat(unitFile); err != nil {
+		return err
+	}
+	if err := systemctl("disable", "--now", name+".service"); err != nil {
+		return err
+	}
+	if err := os.Remove(unitFile); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+func systemctl(args ...string) error {
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return errors.New("systemctl " + strings.Join(args, " ") + " failed: " + strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+//go:build !windows && !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// There is no service manager we know how to integrate with on this platform, always run as a console application
+func isPlatformService() (bool, error) {
+	return false, nil
+}
+
+func newServiceLogger(fileCore zapcore.Core) *zap.Logger {
+	return zap.New(fileCore)
+}
+
+func prepareServiceEnvironment(configFile string) {}
+
+func runPlatformService(ctx context.Context, name string) {
+	runServer(ctx)
+}
+
+func activatedListeners() map[int]net.Listener {
+	return map[int]net.Listener{}
+}
+
+func notifyReady() {}
+
+func notifyStopping() {}
+
+func setupPlatformSignalHandling() {}
+
+func installService(name string, executable string, configFile string) error {
+	return errors.New("installing as a service is not supported on this platform")
+}
+
+func uninstallService(name string) error {
+	return errors.New("uninstalling a service is not supported on this platform")
+}
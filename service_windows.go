@@ -0,0 +1,128 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+type tm1AdminHostService struct {
+	ctx context.Context
+}
+
+func (m *tm1AdminHostService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (svcSpecificEC bool, exitCode uint32) {
+	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		runServer(ctx)
+		close(stopped)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+loop:
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			changes <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			break loop
+		}
+	}
+	changes <- svc.Status{State: svc.StopPending, WaitHint: uint32((viper.GetDuration("shutdown.drain-timeout") + 5*time.Second).Milliseconds())}
+
+	// Gracefully shutdown the admin listeners and all reverse proxies for our active servers
+	cancel()
+	<-stopped
+
+	return
+}
+
+// Determine if the service is being started as a Windows service
+func isPlatformService() (bool, error) {
+	return svc.IsWindowsService()
+}
+
+// Windows services get started in the system directory, run from the directory of the config file, or that of the
+// executable, instead so relative paths in the configuration resolve as they would for a console application
+func prepareServiceEnvironment(configFile string) {
+	dir := filepath.Dir(configFile)
+	if configFile == "" {
+		if executable, err := os.Executable(); err == nil {
+			dir = filepath.Dir(executable)
+		}
+	}
+	os.Chdir(dir)
+}
+
+// Windows services log to the log file only
+func newServiceLogger(fileCore zapcore.Core) *zap.Logger {
+	return zap.New(fileCore)
+}
+
+func runPlatformService(ctx context.Context, name string) {
+	run := svc.Run
+	logger.Info("Starting " + name + " Windows service")
+	err := run(name, &tm1AdminHostService{ctx: ctx})
+	if err != nil {
+		logger.Error("Service "+name+" failed to start", zap.Error(err))
+		return
+	}
+	logger.Info("Service " + name + " stopped")
+}
+
+// The service control manager doesn't hand us any listeners
+func activatedListeners() map[int]net.Listener {
+	return map[int]net.Listener{}
+}
+
+// The service control manager learns about our state through Execute, no need to notify it separately
+func notifyReady() {}
+
+func notifyStopping() {}
+
+func setupPlatformSignalHandling() {}
+
+// Register the admin host with the service control manager, starting automatically
+func installService(name string, executable string, configFile string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	service, err := m.CreateService(name, executable, mgr.Config{
+		DisplayName: "TM1 v12 admin host",
+		Description: "Advertises the databases of TM1 v12 service instances to clients expecting TM1 v11 servers",
+		StartType:   mgr.StartAutomatic,
+	}, "serve", "--config", configFile)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	service, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+	return service.Delete()
+}
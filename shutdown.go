@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+var (
+	// Context of all requests being served, cancelled when requests are still in flight once the drain timeout expired
+	requestsContext, cancelRequests = context.WithCancel(context.Background())
+
+	draining         atomic.Bool
+	drainStarted     = make(chan struct{}) // Closed once we start draining, so long-lived requests can end
+	inFlightRequests atomic.Int64
+)
+
+// Base context for all our HTTP servers, so in-flight requests get cancelled when they are forcibly closed
+func serverBaseContext(net.Listener) context.Context {
+	return requestsContext
+}
+
+// Keep track of the requests in flight, rejecting new requests once we started draining
+func trackInFlight(listener string, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if draining.Load() {
+		retryAfter := int(viper.GetDuration("shutdown.retry-after").Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.Header().Set("Connection", "close")
+		writeODataError(w, r, http.StatusServiceUnavailable, errorCodeShuttingDown, "The service is shutting down")
+		return
+	}
+	inFlightRequests.Add(1)
+	requestsInFlight.WithLabelValues(listener).Inc()
+	defer func() {
+		requestsInFlight.WithLabelValues(listener).Dec()
+		inFlightRequests.Add(-1)
+	}()
+	next.ServeHTTP(w, r)
+}
+
+// Shut down an HTTP server, forcibly closing it if its requests didn't finish before the context expired. Servers
+// that never got started, as their configuration was invalid, have nothing to shut down.
+func shutdownHTTPServer(ctx context.Context, server *http.Server) error {
+	if server == nil {
+		return nil
+	}
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		server.Close()
+	}
+	return err
+}
+
+// Shut down an HTTP server that is no longer needed while we keep running, draining its requests in flight in the
+// background. Returns once the server stopped listening, so its port can be used again right away. Errors shutting
+// down are passed to failed.
+func drainHTTPServer(server *http.Server, failed func(error)) {
+	if server == nil {
+		return
+	}
+	stoppedListening := make(chan struct{})
+	server.RegisterOnShutdown(func() { close(stoppedListening) })
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := newServerShutdownContext()
+		defer cancel()
+		if err := shutdownHTTPServer(ctx, server); err != nil {
+			failed(err)
+		}
+	}()
+	<-stoppedListening
+}
+
+// Returns the context used to shut down a server that is no longer needed while we keep running
+func newServerShutdownContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), viper.GetDuration("shutdown.drain-timeout"))
+}
+
+// Drain the requests in flight, rejecting any new ones, then shut down the servers, the PA proxy and the admin
+// listeners. Anything still in flight once the drain timeout expires gets cancelled.
+func drainAndShutdown(adminServers []*http.Server) {
+	timeout := viper.GetDuration("shutdown.drain-timeout")
+	deadline := time.Now().Add(timeout)
+	draining.Store(true)
+	close(drainStarted)
+	logger.Info("Draining requests in flight", zap.Int64("in-flight", inFlightRequests.Load()), zap.Duration("timeout", timeout))
+
+	// Wait for the requests in flight to finish, or for the drain timeout to expire
+	for inFlightRequests.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if remaining := inFlightRequests.Load(); remaining > 0 {
+		logger.Warn("Drain timeout expired, cancelling requests still in flight", zap.Int64("in-flight", remaining))
+		cancelRequests()
+	} else {
+		logger.Info("All requests in flight finished")
+	}
+
+	// Shut down the servers and the admin listeners, forcibly if they don't shut down in time
+	ctx, cancel := context.WithTimeout(context.Background(), time.Until(deadline)+time.Second)
+	defer cancel()
+	shutdownAllServers(ctx)
+	for _, server := range adminServers {
+		if err := shutdownHTTPServer(ctx, server); err != nil {
+			logger.Error("Error shutting down admin listener", zap.Error(err), zap.String("address", server.Addr))
+		}
+	}
+	cancelRequests()
+}
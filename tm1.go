@@ -1,11 +1,12 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
 	"encoding/json"
 	"io"
 	"net/http"
 	"strings"
+	"text/template"
 
 	"github.com/spf13/viper"
 )
@@ -35,10 +36,97 @@ type DatabasesResponse struct {
 	Databases  []Database `json:"value"`
 }
 
-func listDatabases() ([]Database, error) {
+// Define a struct for a TM1 v12 service instance of which the databases are advertised as servers
+type tm1Instance struct {
+	Name                string           `mapstructure:"name"`
+	DatabasesURL        string           `mapstructure:"databases-url"`
+	DatabaseURLTemplate string           `mapstructure:"database-url-template"`
+	ReplicaURLTemplate  string           `mapstructure:"replica-url-template"`
+	WriterRole          string           `mapstructure:"writer-role"`
+	NamePrefix          string           `mapstructure:"name-prefix"`
+	NameSuffix          string           `mapstructure:"name-suffix"`
+	Include             []databaseFilter `mapstructure:"include"`
+	Exclude             []databaseFilter `mapstructure:"exclude"`
+	Aliases             []databaseAlias  `mapstructure:"aliases"`
+	Auth                tm1AuthConfig    `mapstructure:"auth"`
+}
+
+// Returns the TM1 v12 service instances, as validated when the configuration was built
+func tm1Instances() []tm1Instance {
+	instances, _ := viper.Get("tm1-v12.instances$").([]tm1Instance)
+	return instances
+}
+
+// Returns the TM1 v12 service instance with the specified name, nil if there is none
+func lookupTM1Instance(name string) *tm1Instance {
+	instances := tm1Instances()
+	for i := range instances {
+		if instances[i].Name == name {
+			return &instances[i]
+		}
+	}
+	return nil
+}
+
+// Returns the name of the server advertising a database of this instance, which is its alias if it has one
+func (instance *tm1Instance) serverName(database string) string {
+	for _, alias := range instance.Aliases {
+		if strings.EqualFold(alias.Database, database) {
+			return alias.Server
+		}
+	}
+	return instance.NamePrefix + database + instance.NameSuffix
+}
+
+// Render the service root URL of a database of this instance using the database URL template
+func (instance *tm1Instance) databaseServiceRootURL(database string) (string, error) {
+	// Map with the variables used to execute the template
+	data := map[string]interface{}{
+		"database": database,
+	}
+
+	// Parse the template
+	databaseUrlTemplate, err := template.New("datbaseUrl").Parse(instance.DatabaseURLTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	// Execute the template with the data
+	var target bytes.Buffer
+	err = databaseUrlTemplate.Execute(&target, data)
+	if err != nil {
+		return "", err
+	}
+	return target.String(), nil
+}
+
+// Render the service root URL of a specific replica of a database of this instance using the replica URL template
+func (instance *tm1Instance) replicaServiceRootURL(database string, replica string) (string, error) {
+	// Map with the variables used to execute the template
+	data := map[string]interface{}{
+		"database": database,
+		"replica":  replica,
+	}
+
+	// Parse the template
+	replicaUrlTemplate, err := template.New("replicaUrl").Parse(instance.ReplicaURLTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	// Execute the template with the data
+	var target bytes.Buffer
+	err = replicaUrlTemplate.Execute(&target, data)
+	if err != nil {
+		return "", err
+	}
+	return target.String(), nil
+}
+
+func listDatabases(instance *tm1Instance) ([]Database, error) {
 	// Build the request URL requesting the collection of databases
 	var reqUrl string
-	databasesResourceAndQuery := strings.SplitN(viper.GetString("tm1-v12.databases-url"), "?", 2)
+	databasesResourceAndQuery := strings.SplitN(instance.DatabasesURL, "?", 2)
 	reqUrl = databasesResourceAndQuery[0] + "?$select=ID,Name,ProductVersion,ServiceRootURL,Replicas&$expand=ActiveReplicas($select=ID,State,Role)"
 	if len(databasesResourceAndQuery) > 1 && databasesResourceAndQuery[1] != "" {
 		queryAndFragment := strings.SplitN(databasesResourceAndQuery[1], "#", 2)
@@ -55,10 +143,12 @@ func listDatabases() ([]Database, error) {
 	}
 
 	// Add the Authorization header to the request
-	req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(viper.GetString("tm1-v12.auth.basic.username")+":"+viper.GetString("tm1-v12.auth.basic.password"))))
+	if err := authorizeTM1Request(req, instance); err != nil {
+		return nil, err
+	}
 
-	// Send the request using an HTTP client
-	client := &http.Client{}
+	// Send the request using the transport shared by all requests to TM1 v12
+	client := newUpstreamClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -71,6 +161,14 @@ func listDatabases() ([]Database, error) {
 		return nil, err
 	}
 
+	// Make sure we got the list of databases and not an error
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			tm1RequestUnauthorized(instance)
+		}
+		return nil, newUpstreamError(resp, body)
+	}
+
 	// Retrieve the list of databases from the body
 	var databasesResponse DatabasesResponse
 	if err := json.Unmarshal(body, &databasesResponse); err != nil {
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Transport shared by all requests to TM1 v12, the requests for the databases as well as all server proxies. It
+// delegates to the transport built from the current configuration, so changes apply without restarting the proxies.
+type sharedTransport struct {
+	current atomic.Pointer[http.Transport]
+}
+
+var upstreamTransport = &sharedTransport{}
+
+func (st *sharedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := st.current.Load()
+	if transport == nil {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	return transport.RoundTrip(req)
+}
+
+// Returns an HTTP client sending requests to TM1 v12 using the shared transport
+func newUpstreamClient() *http.Client {
+	return &http.Client{Transport: upstreamTransport}
+}
+
+// Build the transport from the tm1-v12.tls and tm1-v12.transport settings and start using it for all new requests
+func configureUpstreamTransport() error {
+	tlsConfig, err := newUpstreamTLSConfig()
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{
+		Timeout:   viper.GetDuration("tm1-v12.transport.dial-timeout"),
+		KeepAlive: viper.GetDuration("tm1-v12.transport.keep-alive"),
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   viper.GetDuration("tm1-v12.transport.tls-handshake-timeout"),
+		ResponseHeaderTimeout: viper.GetDuration("tm1-v12.transport.response-header-timeout"),
+		ExpectContinueTimeout: viper.GetDuration("tm1-v12.transport.expect-continue-timeout"),
+		IdleConnTimeout:       viper.GetDuration("tm1-v12.transport.idle-conn-timeout"),
+		MaxIdleConns:          viper.GetInt("tm1-v12.transport.max-idle-conns"),
+		MaxIdleConnsPerHost:   viper.GetInt("tm1-v12.transport.max-idle-conns-per-host"),
+		MaxConnsPerHost:       viper.GetInt("tm1-v12.transport.max-conns-per-host"),
+		ForceAttemptHTTP2:     viper.GetBool("tm1-v12.transport.http2"),
+	}
+
+	// Setting TLSNextProto to an empty map is the way to disable HTTP/2
+	if !viper.GetBool("tm1-v12.transport.http2") {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	// Swap in the new transport, letting the connections of the previous one go once they are idle
+	if previous := upstreamTransport.current.Swap(transport); previous != nil {
+		previous.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Build the TLS configuration used to connect to TM1 v12
+func newUpstreamTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         viper.GetString("tm1-v12.tls.server-name"),
+		InsecureSkipVerify: viper.GetBool("tm1-v12.tls.insecure-skip-verify"),
+	}
+	if tlsConfig.InsecureSkipVerify {
+		logger.Warn("Certificates of TM1 v12 are not being verified, only use this for testing!", zap.Bool("tm1-v12.tls.insecure-skip-verify", true))
+	}
+
+	// Trust the certificate authorities in the bundle, on top of those trusted by the system
+	if caFile := viper.GetString("tm1-v12.tls.ca-file"); caFile != "" {
+		caData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no certificates found in certificate authority file " + caFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	// Present a client certificate, if TM1 v12 requires one
+	certFile := viper.GetString("tm1-v12.tls.cert-file")
+	keyFile := viper.GetString("tm1-v12.tls.key-file")
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}